@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+const usage = `usage: rama <command> [flags]
+
+commands:
+  table build   print every row of a table built from a member file
+  table lookup  print the member addresses map to
+  table stats   print how many rows each member owns
+  table diff    print how many rows move between two member files
+  topk          print the top talkers in a pcap or pcapng file
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run writes results to out and flag usage and errors to errOut so they
+// never end up mixed into json output
+func run(args []string, in io.Reader, out io.Writer, errOut io.Writer) error {
+	if len(args) < 1 {
+		return fmt.Errorf("%v", usage)
+	}
+
+	switch args[0] {
+	case "table":
+		return runTable(args[1:], out, errOut)
+	case "topk":
+		return runTopK(args[1:], in, out, errOut)
+	default:
+		return fmt.Errorf("unknown command: %v\n%v", args[0], usage)
+	}
+}
+
+// output writes v as indented json or rows as a human readable table
+func output(out io.Writer, asJSON bool, v any, header []string, rows [][]any) error {
+	if asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for i, h := range header {
+		if i > 0 {
+			fmt.Fprint(w, "\t")
+		}
+		fmt.Fprint(w, h)
+	}
+	fmt.Fprintln(w)
+
+	for _, row := range rows {
+		for i, col := range row {
+			if i > 0 {
+				fmt.Fprint(w, "\t")
+			}
+			fmt.Fprint(w, col)
+		}
+		fmt.Fprintln(w)
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joewilliams/rama/pkg/pcap"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestTable(t *testing.T) {
+	before := writeConfig(t, "before.yaml", "key: 1234\nsize: 16\nmembers: [192.0.2.1, 192.0.2.2, 192.0.2.3]\n")
+	after := writeConfig(t, "after.yaml", "key: 1234\nmembers: [192.0.2.2, 192.0.2.3, 192.0.2.4]\n")
+	weighted := writeConfig(t, "weighted.json", `{"key": 1234, "size": 16, "weights": {"192.0.2.1": 1, "192.0.2.2": 3}}`)
+
+	var out bytes.Buffer
+	assert.Nil(t, run([]string{"table", "build", "-config", before, "-json"}, nil, &out, io.Discard))
+	rows := []row{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &rows))
+	assert.Equal(t, 16, len(rows))
+	for _, r := range rows {
+		assert.NotEqual(t, r.Primary, r.Secondary)
+	}
+
+	out.Reset()
+	assert.Nil(t, run([]string{"table", "lookup", "-config", before, "-json", "10.0.0.1", "2001:db8::1"}, nil, &out, io.Discard))
+	lookups := []lookup{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &lookups))
+	assert.Equal(t, 2, len(lookups))
+	assert.Equal(t, netip.MustParseAddr("2001:db8::1"), lookups[1].Addr)
+
+	out.Reset()
+	assert.Nil(t, run([]string{"table", "stats", "-config", weighted, "-json"}, nil, &out, io.Discard))
+	s := stats{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &s))
+	assert.Equal(t, uint32(16), s.Size)
+	assert.Equal(t, 2, len(s.Members))
+	assert.Equal(t, float64(3), s.Members[1].Weight)
+	assert.Equal(t, uint32(16), s.Members[0].Rows+s.Members[1].Rows)
+
+	out.Reset()
+	assert.Nil(t, run([]string{"table", "diff", "-config", before, "-other", after, "-json"}, nil, &out, io.Discard))
+	d := diff{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &d))
+	assert.Equal(t, uint32(16), d.Size)
+	assert.Equal(t, 4, len(d.Members))
+	assert.Equal(t, uint32(0), d.Members[0].After)
+	assert.Equal(t, uint32(0), d.Members[3].Before)
+	assert.True(t, d.Moved >= d.Members[0].Before)
+
+	out.Reset()
+	assert.Nil(t, run([]string{"table", "stats", "-config", before}, nil, &out, io.Discard))
+	assert.True(t, strings.HasPrefix(out.String(), "MEMBER"))
+
+	assert.NotNil(t, run([]string{}, nil, &out, io.Discard))
+	assert.NotNil(t, run([]string{"nope"}, nil, &out, io.Discard))
+	assert.NotNil(t, run([]string{"table", "build"}, nil, &out, io.Discard))
+	assert.NotNil(t, run([]string{"table", "diff", "-config", before}, nil, &out, io.Discard))
+	assert.NotNil(t, run([]string{"table", "lookup", "-config", before, "not-an-ip"}, nil, &out, io.Discard))
+
+	// usage and flag errors stay out of the output
+	var errOut bytes.Buffer
+	out.Reset()
+	assert.NotNil(t, run([]string{"table", "build", "-nope"}, nil, &out, &errOut))
+	assert.Equal(t, "", out.String())
+	assert.Contains(t, errOut.String(), "-config")
+
+	errOut.Reset()
+	assert.NotNil(t, run([]string{"topk", "-nope"}, nil, &out, &errOut))
+	assert.Equal(t, "", out.String())
+	assert.Contains(t, errOut.String(), "-file")
+}
+
+func writePcap(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	f, err := os.Create(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	w, err := pcap.NewWriter(f, pcap.LinkTypeRaw, 0)
+	assert.Nil(t, err)
+
+	packet := func(src string, dst string, dstPort uint16, length int) []byte {
+		data := make([]byte, length)
+		data[0] = 0x45
+		data[9] = pcap.ProtoTCP
+		s := netip.MustParseAddr(src).As4()
+		d := netip.MustParseAddr(dst).As4()
+		copy(data[12:16], s[:])
+		copy(data[16:20], d[:])
+		binary.BigEndian.PutUint16(data[22:24], dstPort)
+		return data
+	}
+
+	// one heavy sender with few large packets and one with many small ones
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, w.WritePacket(pcap.Packet{Data: packet("192.0.2.1", "198.51.100.1", 443, 40)}))
+		if i%10 == 0 {
+			assert.Nil(t, w.WritePacket(pcap.Packet{Data: packet("192.0.2.2", "198.51.100.1", 80, 1500)}))
+		}
+		if i%50 == 0 {
+			assert.Nil(t, w.WritePacket(pcap.Packet{Data: packet("192.0.2.3", "198.51.100.2", 80, 40)}))
+		}
+	}
+	// not ip
+	assert.Nil(t, w.WritePacket(pcap.Packet{Data: []byte{0}}))
+
+	return path
+}
+
+func TestTopK(t *testing.T) {
+	path := writePcap(t)
+
+	var out bytes.Buffer
+	assert.Nil(t, run([]string{"topk", "-file", path, "-k", "2", "-seed", "1", "-json"}, nil, &out, io.Discard))
+	result := topkResult{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &result))
+	assert.Equal(t, uint64(112), result.Packets)
+	assert.Equal(t, uint64(100*40+10*1500+2*40), result.Bytes)
+	assert.Equal(t, uint64(1), result.Skipped)
+	assert.Equal(t, 2, len(result.Talkers))
+	assert.Equal(t, talker{Key: "192.0.2.1", Packets: 100, Bytes: 4000}, result.Talkers[0])
+	assert.Equal(t, talker{Key: "192.0.2.2", Packets: 10, Bytes: 15000}, result.Talkers[1])
+
+	// the large packets win when ranked by bytes
+	out.Reset()
+	assert.Nil(t, run([]string{"topk", "-file", path, "-k", "2", "-weight", "bytes", "-seed", "1", "-json"}, nil, &out, io.Discard))
+	result = topkResult{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &result))
+	assert.Equal(t, talker{Key: "192.0.2.2", Packets: 10, Bytes: 15000}, result.Talkers[0])
+	assert.Equal(t, talker{Key: "192.0.2.1", Packets: 100, Bytes: 4000}, result.Talkers[1])
+
+	out.Reset()
+	assert.Nil(t, run([]string{"topk", "-file", path, "-key", "dst", "-seed", "1", "-json"}, nil, &out, io.Discard))
+	result = topkResult{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &result))
+	assert.Equal(t, 2, len(result.Talkers))
+	assert.Equal(t, "198.51.100.1", result.Talkers[0].Key)
+	assert.Equal(t, uint64(110), result.Talkers[0].Packets)
+
+	// captures can be streamed in on stdin
+	capture, err := os.ReadFile(path)
+	assert.Nil(t, err)
+
+	out.Reset()
+	assert.Nil(t, run([]string{"topk", "-file", "-", "-k", "1", "-seed", "1", "-json"}, bytes.NewReader(capture), &out, io.Discard))
+	result = topkResult{}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &result))
+	assert.Equal(t, uint64(112), result.Packets)
+	assert.Equal(t, []talker{{Key: "192.0.2.1", Packets: 100, Bytes: 4000}}, result.Talkers)
+
+	out.Reset()
+	assert.Nil(t, run([]string{"topk", "-file", path, "-key", "flow", "-k", "1", "-seed", "1"}, nil, &out, io.Discard))
+	assert.Contains(t, out.String(), "6 192.0.2.1:0 -> 198.51.100.1:443")
+
+	assert.NotNil(t, run([]string{"topk"}, nil, &out, io.Discard))
+	assert.NotNil(t, run([]string{"topk", "-file", path, "-key", "nope"}, nil, &out, io.Discard))
+	assert.Nil(t, run([]string{"topk", "-file", path, "-decay", "0"}, nil, &out, io.Discard))
+	assert.Nil(t, run([]string{"topk", "-file", path, "-decay", "1"}, nil, &out, io.Discard))
+	assert.NotNil(t, run([]string{"topk", "-file", path, "-decay", "-0.1"}, nil, &out, io.Discard))
+	assert.NotNil(t, run([]string{"topk", "-file", path, "-decay", "2"}, nil, &out, io.Discard))
+	assert.NotNil(t, run([]string{"topk", "-file", path, "-decay", "NaN"}, nil, &out, io.Discard))
+	assert.NotNil(t, run([]string{"topk", "-file", path, "-weight", "nope"}, nil, &out, io.Discard))
+	assert.NotNil(t, run([]string{"topk", "-file", filepath.Join(t.TempDir(), "missing.pcap")}, nil, &out, io.Discard))
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+
+	"github.com/joewilliams/rama/pkg/member_config"
+	"github.com/joewilliams/rama/pkg/rendezvous"
+	"github.com/joewilliams/rama/pkg/weighted_rendezvous"
+	"golang.org/x/exp/slices"
+)
+
+// table is what the subcommands need from both rendezvous packages
+type table interface {
+	Key() uint64
+	Size() uint32
+	Get(addr netip.Addr) netip.Addr
+	Rows() ([]netip.Addr, []netip.Addr)
+	Stats() map[netip.Addr]uint32
+}
+
+type row struct {
+	Row       uint32     `json:"row"`
+	Primary   netip.Addr `json:"primary"`
+	Secondary netip.Addr `json:"secondary"`
+}
+
+type lookup struct {
+	Addr   netip.Addr `json:"addr"`
+	Member netip.Addr `json:"member"`
+}
+
+type memberStats struct {
+	Member  netip.Addr `json:"member"`
+	Weight  float64    `json:"weight,omitempty"`
+	Rows    uint32     `json:"rows"`
+	Percent float64    `json:"percent"`
+}
+
+type stats struct {
+	Key     uint64        `json:"key"`
+	Size    uint32        `json:"size"`
+	Members []memberStats `json:"members"`
+	// spread of rows per member relative to a perfectly even split
+	MinRows uint32  `json:"min_rows"`
+	MaxRows uint32  `json:"max_rows"`
+	StdDev  float64 `json:"stddev"`
+}
+
+type memberDiff struct {
+	Member netip.Addr `json:"member"`
+	Before uint32     `json:"before"`
+	After  uint32     `json:"after"`
+}
+
+type diff struct {
+	Size    uint32       `json:"size"`
+	Moved   uint32       `json:"moved"`
+	Percent float64      `json:"percent"`
+	Members []memberDiff `json:"members"`
+}
+
+func runTable(args []string, out io.Writer, errOut io.Writer) error {
+	if len(args) < 1 {
+		return fmt.Errorf("%v", usage)
+	}
+
+	flags := flag.NewFlagSet("table "+args[0], flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	configPath := flags.String("config", "", "member file (json or yaml)")
+	otherPath := flags.String("other", "", "member file to diff against")
+	asJSON := flags.Bool("json", false, "output json")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if *configPath == "" {
+		return fmt.Errorf("-config is required")
+	}
+
+	config, err := member_config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+
+	t, err := newTable(config, config.Size)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "build":
+		return tableBuild(out, *asJSON, t)
+	case "lookup":
+		return tableLookup(out, *asJSON, t, flags.Args())
+	case "stats":
+		return tableStats(out, *asJSON, t, config)
+	case "diff":
+		if *otherPath == "" {
+			return fmt.Errorf("-other is required")
+		}
+
+		other, err := member_config.Load(*otherPath)
+		if err != nil {
+			return err
+		}
+
+		// both tables need the same size for rows to line up
+		o, err := newTable(other, t.Size())
+		if err != nil {
+			return err
+		}
+
+		return tableDiff(out, *asJSON, t, o)
+	default:
+		return fmt.Errorf("unknown table command: %v\n%v", args[0], usage)
+	}
+}
+
+// newTable builds a weighted table if the config has weights
+func newTable(config member_config.Config, size uint32) (table, error) {
+	if len(config.Weights) > 0 {
+		if err := config.ValidateWeighted(); err != nil {
+			return nil, err
+		}
+
+		var t weighted_rendezvous.Table
+		var err error
+		if size == 0 {
+			t, err = weighted_rendezvous.New(config.Key, config.Weights)
+		} else {
+			t, err = weighted_rendezvous.NewWithTableSize(config.Key, size, config.Weights)
+		}
+		return &t, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	var t rendezvous.Table
+	var err error
+	if size == 0 {
+		t, err = rendezvous.New(config.Key, config.Members)
+	} else {
+		t, err = rendezvous.NewWithTableSize(config.Key, size, config.Members)
+	}
+	return &t, err
+}
+
+func tableBuild(out io.Writer, asJSON bool, t table) error {
+	primary, secondary := t.Rows()
+
+	rows := make([]row, 0, len(primary))
+	human := make([][]any, 0, len(primary))
+	for i := range primary {
+		rows = append(rows, row{Row: uint32(i), Primary: primary[i], Secondary: secondary[i]})
+		human = append(human, []any{i, primary[i], secondary[i]})
+	}
+
+	return output(out, asJSON, rows, []string{"ROW", "PRIMARY", "SECONDARY"}, human)
+}
+
+func tableLookup(out io.Writer, asJSON bool, t table, addrs []string) error {
+	if len(addrs) < 1 {
+		return fmt.Errorf("no addresses to look up")
+	}
+
+	lookups := make([]lookup, 0, len(addrs))
+	human := make([][]any, 0, len(addrs))
+	for _, a := range addrs {
+		addr, err := netip.ParseAddr(a)
+		if err != nil {
+			return err
+		}
+
+		member := t.Get(addr)
+		lookups = append(lookups, lookup{Addr: addr, Member: member})
+		human = append(human, []any{addr, member})
+	}
+
+	return output(out, asJSON, lookups, []string{"ADDR", "MEMBER"}, human)
+}
+
+func tableStats(out io.Writer, asJSON bool, t table, config member_config.Config) error {
+	size := t.Size()
+
+	s := stats{Key: t.Key(), Size: size, MinRows: math.MaxUint32}
+
+	counts := t.Stats()
+	mean := float64(size) / float64(len(counts))
+	var variance float64
+
+	for _, member := range sortedMembers(counts) {
+		rows := counts[member]
+		s.Members = append(s.Members, memberStats{
+			Member:  member,
+			Weight:  config.Weights[member],
+			Rows:    rows,
+			Percent: float64(rows) / float64(size) * 100,
+		})
+
+		s.MinRows = min(s.MinRows, rows)
+		s.MaxRows = max(s.MaxRows, rows)
+		variance = variance + math.Pow(float64(rows)-mean, 2)
+	}
+	s.StdDev = math.Sqrt(variance / float64(len(counts)))
+
+	human := make([][]any, 0, len(s.Members)+1)
+	for _, m := range s.Members {
+		human = append(human, []any{m.Member, m.Weight, m.Rows, fmt.Sprintf("%.2f%%", m.Percent)})
+	}
+	human = append(human, []any{"total", "", size, fmt.Sprintf("min %v max %v stddev %.2f", s.MinRows, s.MaxRows, s.StdDev)})
+
+	return output(out, asJSON, s, []string{"MEMBER", "WEIGHT", "ROWS", "PERCENT"}, human)
+}
+
+func tableDiff(out io.Writer, asJSON bool, before table, after table) error {
+	rowsBefore, _ := before.Rows()
+	rowsAfter, _ := after.Rows()
+
+	d := diff{Size: uint32(len(rowsBefore))}
+	for i := range rowsBefore {
+		if rowsBefore[i] != rowsAfter[i] {
+			d.Moved++
+		}
+	}
+	d.Percent = float64(d.Moved) / float64(d.Size) * 100
+
+	countsBefore := before.Stats()
+	countsAfter := after.Stats()
+
+	all := map[netip.Addr]uint32{}
+	for member := range countsBefore {
+		all[member] = 0
+	}
+	for member := range countsAfter {
+		all[member] = 0
+	}
+
+	human := [][]any{}
+	for _, member := range sortedMembers(all) {
+		d.Members = append(d.Members, memberDiff{Member: member, Before: countsBefore[member], After: countsAfter[member]})
+		human = append(human, []any{member, countsBefore[member], countsAfter[member], int64(countsAfter[member]) - int64(countsBefore[member])})
+	}
+	human = append(human, []any{"moved", "", d.Moved, fmt.Sprintf("%.2f%%", d.Percent)})
+
+	return output(out, asJSON, d, []string{"MEMBER", "BEFORE", "AFTER", "CHANGE"}, human)
+}
+
+func sortedMembers(counts map[netip.Addr]uint32) []netip.Addr {
+	members := make([]netip.Addr, 0, len(counts))
+	for member := range counts {
+		members = append(members, member)
+	}
+
+	slices.SortFunc(members, func(a netip.Addr, b netip.Addr) int {
+		return a.Compare(b)
+	})
+
+	return members
+}
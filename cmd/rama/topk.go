@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/joewilliams/rama/pkg/heavykeeper"
+	"github.com/joewilliams/rama/pkg/pcap"
+)
+
+type talker struct {
+	Key string `json:"key"`
+	// both are heavykeeper estimates, packets and bytes are counted in
+	// separate instances during the same pass
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+type topkResult struct {
+	Packets uint64   `json:"packets"`
+	Bytes   uint64   `json:"bytes"`
+	Skipped uint64   `json:"skipped"`
+	Talkers []talker `json:"talkers"`
+}
+
+func runTopK(args []string, in io.Reader, out io.Writer, errOut io.Writer) error {
+	flags := flag.NewFlagSet("topk", flag.ContinueOnError)
+	flags.SetOutput(errOut)
+	file := flags.String("file", "", "pcap or pcapng file, - for stdin")
+	by := flags.String("key", "src", "rank by src, dst or flow (5-tuple)")
+	k := flags.Uint("k", 10, "number of entries to report")
+	width := flags.Uint64("width", 1024, "buckets per row")
+	depth := flags.Uint("depth", 4, "rows")
+	decay := flags.Float64("decay", 0.9, "decay")
+	weight := flags.String("weight", "packets", "rank by packets or bytes")
+	seed := flags.Uint64("seed", 0, "hash seed, random if zero")
+	asJSON := flags.Bool("json", false, "output json")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *file == "" {
+		return fmt.Errorf("-file is required")
+	}
+
+	if *by != "src" && *by != "dst" && *by != "flow" {
+		return fmt.Errorf("unknown key: %v", *by)
+	}
+
+	if *weight != "packets" && *weight != "bytes" {
+		return fmt.Errorf("unknown weight: %v", *weight)
+	}
+
+	if *k == 0 || *width == 0 || *depth == 0 {
+		return fmt.Errorf("k, width and depth must be greater than zero")
+	}
+
+	// the range the constructors accept rather than letting them panic,
+	// written so NaN fails too
+	if !(*decay >= 0 && *decay <= 1) {
+		return fmt.Errorf("decay must be between 0 and 1")
+	}
+
+	// one instance counts packets and one bytes so both can be reported
+	// for the top talkers without reading the capture twice
+	packets := heavykeeper.NewWtihSeed(uint32(*k), *width, uint32(*depth), *decay, *seed)
+	packets.SetCanonical(true)
+	bytes := heavykeeper.NewWtihSeed(uint32(*k), *width, uint32(*depth), *decay, *seed)
+	bytes.SetCanonical(true)
+
+	ranked := &packets
+	if *weight == "bytes" {
+		ranked = &bytes
+	}
+
+	r := in
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	result := topkResult{}
+
+	err := readFlows(r, func(flow pcap.Flow, length uint32) {
+		result.Packets++
+		result.Bytes = result.Bytes + uint64(length)
+
+		switch *by {
+		case "src":
+			packets.AddAddr(flow.Src)
+			bytes.AddAddrN(flow.Src, uint64(length))
+		case "dst":
+			packets.AddAddr(flow.Dst)
+			bytes.AddAddrN(flow.Dst, uint64(length))
+		case "flow":
+			key := flow.Bytes()
+			packets.AddBytes(key)
+			bytes.AddBytesN(key, uint64(length))
+		}
+	}, &result.Skipped)
+	if err != nil {
+		return err
+	}
+
+	if *by == "flow" {
+		keys, _ := ranked.RankBytes()
+		for _, key := range keys {
+			flow, err := pcap.FlowFromBytes(key)
+			if err != nil {
+				return err
+			}
+
+			p, _ := packets.QueryBytes(key)
+			b, _ := bytes.QueryBytes(key)
+			result.Talkers = append(result.Talkers, talker{Key: flow.String(), Packets: p, Bytes: b})
+		}
+	} else {
+		addrs, _ := ranked.RankAddrs()
+		for _, addr := range addrs {
+			p, _ := packets.QueryAddr(addr)
+			b, _ := bytes.QueryAddr(addr)
+			result.Talkers = append(result.Talkers, talker{Key: addr.String(), Packets: p, Bytes: b})
+		}
+	}
+
+	human := make([][]any, 0, len(result.Talkers)+1)
+	for i, t := range result.Talkers {
+		human = append(human, []any{i + 1, t.Key, t.Packets, t.Bytes})
+	}
+	human = append(human, []any{"total", fmt.Sprintf("skipped %v", result.Skipped), result.Packets, result.Bytes})
+
+	return output(out, *asJSON, result, []string{"RANK", "KEY", "PACKETS", "BYTES"}, human)
+}
+
+// readFlows calls fn with every ip packet in the capture and its length on
+// the wire, packets that can't be decoded are counted in skipped
+func readFlows(r io.Reader, fn func(pcap.Flow, uint32), skipped *uint64) error {
+	reader, err := pcap.NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	for {
+		packet, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		flow, err := pcap.Decode(packet.LinkType, packet.Data)
+		if err != nil {
+			*skipped++
+			continue
+		}
+
+		fn(flow, packet.Length)
+	}
+}
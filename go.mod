@@ -6,10 +6,10 @@ require (
 	github.com/OneOfOne/xxhash v1.2.8
 	github.com/stretchr/testify v1.8.1
 	golang.org/x/exp v0.0.0-20250215185904-eff6e970281f
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,63 @@
+// Package golden checks generated tables against JSON files in testdata so
+// a change to the table output can't go unnoticed.
+package golden
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Check compares every case with testdata/<name>, update rewrites the files
+// first. The files are also hashed together and checked against the sum
+// pinned for the table format version, -update can't change a pinned sum
+// so changed output fails until the version is bumped and a sum for the
+// new version is pinned.
+func Check(t *testing.T, version int, sums map[int]string, update bool, cases map[string]any) {
+	t.Helper()
+
+	hash := sha256.New()
+
+	names := maps.Keys(cases)
+	slices.Sort(names)
+
+	for _, name := range names {
+		got, err := json.MarshalIndent(cases[name], "", "  ")
+		assert.Nil(t, err)
+		got = append(got, '\n')
+
+		path := filepath.Join("testdata", name)
+
+		if update {
+			assert.Nil(t, os.WriteFile(path, got, 0o644))
+		}
+
+		want, err := os.ReadFile(path)
+		assert.Nil(t, err)
+
+		// if this fails the table output changed, which reshuffles every
+		// flow on upgrade, bump TableFormatVersion and regenerate with -update
+		assert.Equal(t, string(want), string(got), name)
+
+		hash.Write([]byte(name))
+		hash.Write(want)
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	pinned, ok := sums[version]
+	if !ok {
+		t.Fatalf("no golden sum pinned for table format version %v, the files hash to %v", version, sum)
+	}
+
+	if pinned != sum {
+		t.Fatalf("golden files changed without a table format version bump from %v, they hash to %v", version, sum)
+	}
+}
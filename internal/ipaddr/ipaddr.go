@@ -0,0 +1,78 @@
+// Package ipaddr has the address handling both rendezvous hashes share,
+// expanding prefixes into members and the canonical and affinity forms of
+// lookup addresses.
+package ipaddr
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// Expand returns every address in the prefix that isn't excluded, prefixes
+// with more than max addresses are refused before being walked
+func Expand(prefix netip.Prefix, exclude []netip.Prefix, max int) ([]netip.Addr, error) {
+	if !prefix.IsValid() {
+		return nil, fmt.Errorf("invalid prefix: %v", prefix)
+	}
+
+	// check the size up front so huge prefixes are never walked
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits > 31 || 1<<hostBits > max {
+		return nil, fmt.Errorf("prefix expands to too many members: %v", prefix)
+	}
+
+	addrs := []netip.Addr{}
+
+	prefix = prefix.Masked()
+	for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+		if !excluded(addr, exclude) {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs, nil
+}
+
+func excluded(addr netip.Addr, exclude []netip.Prefix) bool {
+	for _, prefix := range exclude {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Canonical unmaps IPv4-mapped IPv6 addresses and strips zones
+func Canonical(addr netip.Addr) netip.Addr {
+	return addr.Unmap().WithZone("")
+}
+
+// CanonicalPrefix unmaps an IPv4-mapped IPv6 prefix so it contains the
+// canonical form of its addresses, shorter prefixes are left alone since
+// they also cover addresses that aren't mapped
+func CanonicalPrefix(prefix netip.Prefix) netip.Prefix {
+	if !prefix.Addr().Is4In6() || prefix.Bits() < 96 {
+		return prefix
+	}
+
+	return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+}
+
+// Mask masks addr to v4Bits or v6Bits, IPv4-mapped IPv6 addresses use
+// v4Bits on their low 32 bits
+func Mask(addr netip.Addr, v4Bits int, v6Bits int) netip.Addr {
+	bits := v6Bits
+	switch {
+	case addr.Is4():
+		bits = v4Bits
+	case addr.Is4In6():
+		bits = 96 + v4Bits
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return addr
+	}
+
+	return prefix.Addr()
+}
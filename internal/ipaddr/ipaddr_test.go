@@ -0,0 +1,58 @@
+package ipaddr
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpand(t *testing.T) {
+	addrs, err := Expand(netip.MustParsePrefix("192.0.2.5/30"), []netip.Prefix{netip.MustParsePrefix("192.0.2.6/32")}, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, []netip.Addr{
+		netip.MustParseAddr("192.0.2.4"),
+		netip.MustParseAddr("192.0.2.5"),
+		netip.MustParseAddr("192.0.2.7"),
+	}, addrs)
+
+	addrs, err = Expand(netip.MustParsePrefix("2001:db8::/126"), nil, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(addrs))
+
+	_, err = Expand(netip.MustParsePrefix("2001:db8::/125"), nil, 4)
+	assert.NotNil(t, err)
+	_, err = Expand(netip.MustParsePrefix("2001:db8::/32"), nil, 4096)
+	assert.NotNil(t, err)
+	_, err = Expand(netip.Prefix{}, nil, 4096)
+	assert.NotNil(t, err)
+}
+
+func TestCanonical(t *testing.T) {
+	assert.Equal(t, netip.MustParseAddr("192.0.2.1"), Canonical(netip.MustParseAddr("::ffff:192.0.2.1")))
+	assert.Equal(t, netip.MustParseAddr("fe80::1"), Canonical(netip.MustParseAddr("fe80::1%eth0")))
+
+	prefixes := map[string]string{
+		"::ffff:192.0.2.0/120": "192.0.2.0/24",
+		"::ffff:192.0.2.1/128": "192.0.2.1/32",
+		"::ffff:0.0.0.0/96":    "0.0.0.0/0",
+		// also covers addresses that aren't mapped
+		"::/64":          "::/64",
+		"192.0.2.0/24":   "192.0.2.0/24",
+		"2001:db8::/120": "2001:db8::/120",
+	}
+
+	for prefix, want := range prefixes {
+		assert.Equal(t, netip.MustParsePrefix(want), CanonicalPrefix(netip.MustParsePrefix(prefix)), prefix)
+	}
+}
+
+func TestMask(t *testing.T) {
+	assert.Equal(t, netip.MustParseAddr("192.0.2.0"), Mask(netip.MustParseAddr("192.0.2.77"), 24, 56))
+	assert.Equal(t, netip.MustParseAddr("::ffff:192.0.2.0"), Mask(netip.MustParseAddr("::ffff:192.0.2.77"), 24, 56))
+	assert.Equal(t, netip.MustParseAddr("2001:db8:0:ab00::"), Mask(netip.MustParseAddr("2001:db8:0:abcd::1"), 24, 56))
+	assert.Equal(t, netip.MustParseAddr("192.0.2.77"), Mask(netip.MustParseAddr("192.0.2.77"), 32, 128))
+
+	// masking drops the zone
+	assert.Equal(t, netip.MustParseAddr("fe80::"), Mask(netip.MustParseAddr("fe80::1%eth0"), 24, 56))
+}
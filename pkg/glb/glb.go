@@ -0,0 +1,417 @@
+package glb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+
+	"github.com/joewilliams/rama/pkg/rendezvous"
+)
+
+// the layout follows glb_fwd_config.h from glb-director, everything is
+// packed and little endian except addresses which are in network order
+
+const (
+	MagicWord = 0x44424c47 // "GLBD"
+	Version   = 2
+
+	// the defaults are also the largest sizes glb-director accepts
+	DefaultMaxBackends = 0x100
+	DefaultMaxBinds    = 0x100
+	MaxTableEntries    = 0x10000
+
+	secureKeyBytes = 16
+	addrBytes      = 16
+
+	// packed sizes of the structs below
+	tableHeaderBytes = 8 + secureKeyBytes
+	backendBytes     = 4 + addrBytes + 4
+	bindBytes        = 4 + addrBytes + 8
+	entryBytes       = 8
+
+	familyIPv4 = 1
+	familyIPv6 = 2
+)
+
+const (
+	StateFilling uint16 = iota
+	StateActive
+	StateDrainingInactive
+)
+
+type Backend struct {
+	Addr    netip.Addr
+	State   uint16
+	Healthy bool
+}
+
+type Bind struct {
+	Prefix    netip.Prefix
+	PortStart uint16
+	PortEnd   uint16
+	Proto     uint8
+}
+
+type Entry struct {
+	Primary   uint32
+	Secondary uint32
+}
+
+type Table struct {
+	SecureKey [secureKeyBytes]byte
+	Backends  []Backend
+	Binds     []Bind
+	Entries   []Entry
+}
+
+type Config struct {
+	TableEntries uint32
+	MaxBackends  uint32
+	MaxBinds     uint32
+	Tables       []Table
+}
+
+type header struct {
+	MagicWord    uint32
+	Version      uint32
+	NumTables    uint32
+	TableEntries uint32
+	MaxBackends  uint32
+	MaxBinds     uint32
+}
+
+type tableHeader struct {
+	NumBackends uint32
+	NumBinds    uint32
+	SecureKey   [secureKeyBytes]byte
+}
+
+type backend struct {
+	Family  uint32
+	Addr    [addrBytes]byte
+	State   uint16
+	Healthy uint16
+}
+
+type bind struct {
+	Family    uint32
+	Addr      [addrBytes]byte
+	Bits      uint16
+	PortStart uint16
+	PortEnd   uint16
+	Proto     uint8
+	Reserved  uint8
+}
+
+// FromRendezvous builds a forwarding table from a rendezvous table, every
+// member is an active and healthy backend and the rendezvous key fills the
+// first 8 bytes of the secure key
+func FromRendezvous(r *rendezvous.Table, binds []Bind) Table {
+	members := r.Members()
+	index := make(map[netip.Addr]uint32, len(members))
+
+	table := Table{
+		Backends: make([]Backend, 0, len(members)),
+		Binds:    binds,
+	}
+
+	binary.LittleEndian.PutUint64(table.SecureKey[:], r.Key())
+
+	for i, addr := range members {
+		index[addr] = uint32(i)
+		table.Backends = append(table.Backends, Backend{Addr: addr, State: StateActive, Healthy: true})
+	}
+
+	primary, secondary := r.Rows()
+	table.Entries = make([]Entry, len(primary))
+	for i := range primary {
+		table.Entries[i] = Entry{Primary: index[primary[i]], Secondary: index[secondary[i]]}
+	}
+
+	return table
+}
+
+func (c *Config) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, *c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Config) UnmarshalBinary(data []byte) error {
+	config, err := decode(data)
+	if err != nil {
+		return err
+	}
+	*c = config
+	return nil
+}
+
+func Encode(w io.Writer, c Config) error {
+	if c.MaxBackends == 0 {
+		c.MaxBackends = DefaultMaxBackends
+	}
+
+	if c.MaxBinds == 0 {
+		c.MaxBinds = DefaultMaxBinds
+	}
+
+	if err := checkLimits(c); err != nil {
+		return err
+	}
+
+	h := header{
+		MagicWord:    MagicWord,
+		Version:      Version,
+		NumTables:    uint32(len(c.Tables)),
+		TableEntries: c.TableEntries,
+		MaxBackends:  c.MaxBackends,
+		MaxBinds:     c.MaxBinds,
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, h); err != nil {
+		return err
+	}
+
+	for i, t := range c.Tables {
+		if err := encodeTable(w, c, t); err != nil {
+			return fmt.Errorf("table %v: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func encodeTable(w io.Writer, c Config, t Table) error {
+	if uint32(len(t.Backends)) > c.MaxBackends {
+		return fmt.Errorf("too many backends: %v", len(t.Backends))
+	}
+
+	if uint32(len(t.Binds)) > c.MaxBinds {
+		return fmt.Errorf("too many binds: %v", len(t.Binds))
+	}
+
+	if uint32(len(t.Entries)) != c.TableEntries {
+		return fmt.Errorf("wrong number of entries: %v", len(t.Entries))
+	}
+
+	th := tableHeader{
+		NumBackends: uint32(len(t.Backends)),
+		NumBinds:    uint32(len(t.Binds)),
+		SecureKey:   t.SecureKey,
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, th); err != nil {
+		return err
+	}
+
+	// unused slots are zeroed up to the max
+	backends := make([]backend, c.MaxBackends)
+	for i, b := range t.Backends {
+		family, addr, err := encodeAddr(b.Addr)
+		if err != nil {
+			return err
+		}
+
+		backends[i] = backend{Family: family, Addr: addr, State: b.State}
+		if b.Healthy {
+			backends[i].Healthy = 1
+		}
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, backends); err != nil {
+		return err
+	}
+
+	binds := make([]bind, c.MaxBinds)
+	for i, b := range t.Binds {
+		family, addr, err := encodeAddr(b.Prefix.Addr())
+		if err != nil {
+			return err
+		}
+
+		binds[i] = bind{
+			Family:    family,
+			Addr:      addr,
+			Bits:      uint16(b.Prefix.Bits()),
+			PortStart: b.PortStart,
+			PortEnd:   b.PortEnd,
+			Proto:     b.Proto,
+		}
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, binds); err != nil {
+		return err
+	}
+
+	for i, e := range t.Entries {
+		if e.Primary >= uint32(len(t.Backends)) || e.Secondary >= uint32(len(t.Backends)) {
+			return fmt.Errorf("entry %v references a missing backend", i)
+		}
+	}
+
+	return binary.Write(w, binary.LittleEndian, t.Entries)
+}
+
+// Decode reads a whole forwarding table, sizes in the headers are checked
+// against the glb-director limits and the remaining input before anything
+// is allocated
+func Decode(r io.Reader) (Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Config{}, err
+	}
+
+	return decode(data)
+}
+
+func decode(data []byte) (Config, error) {
+	r := bytes.NewReader(data)
+
+	var h header
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return Config{}, err
+	}
+
+	if h.MagicWord != MagicWord {
+		return Config{}, fmt.Errorf("bad magic word: %#x", h.MagicWord)
+	}
+
+	if h.Version != Version {
+		return Config{}, fmt.Errorf("unsupported version: %v", h.Version)
+	}
+
+	c := Config{
+		TableEntries: h.TableEntries,
+		MaxBackends:  h.MaxBackends,
+		MaxBinds:     h.MaxBinds,
+	}
+
+	if err := checkLimits(c); err != nil {
+		return Config{}, err
+	}
+
+	if uint64(h.NumTables)*tableBytes(c) != uint64(r.Len()) {
+		return Config{}, fmt.Errorf("%v tables need %v bytes, have %v", h.NumTables, uint64(h.NumTables)*tableBytes(c), r.Len())
+	}
+
+	c.Tables = make([]Table, 0, h.NumTables)
+	for i := uint32(0); i < h.NumTables; i++ {
+		t, err := decodeTable(r, c)
+		if err != nil {
+			return Config{}, fmt.Errorf("table %v: %w", i, err)
+		}
+		c.Tables = append(c.Tables, t)
+	}
+
+	return c, nil
+}
+
+func decodeTable(r io.Reader, c Config) (Table, error) {
+	var th tableHeader
+	if err := binary.Read(r, binary.LittleEndian, &th); err != nil {
+		return Table{}, err
+	}
+
+	if th.NumBackends > c.MaxBackends || th.NumBinds > c.MaxBinds {
+		return Table{}, fmt.Errorf("too many backends or binds: %v, %v", th.NumBackends, th.NumBinds)
+	}
+
+	t := Table{
+		SecureKey: th.SecureKey,
+		Entries:   make([]Entry, c.TableEntries),
+	}
+
+	backends := make([]backend, c.MaxBackends)
+	if err := binary.Read(r, binary.LittleEndian, backends); err != nil {
+		return Table{}, err
+	}
+
+	for _, b := range backends[:th.NumBackends] {
+		addr, err := decodeAddr(b.Family, b.Addr)
+		if err != nil {
+			return Table{}, err
+		}
+		t.Backends = append(t.Backends, Backend{Addr: addr, State: b.State, Healthy: b.Healthy != 0})
+	}
+
+	binds := make([]bind, c.MaxBinds)
+	if err := binary.Read(r, binary.LittleEndian, binds); err != nil {
+		return Table{}, err
+	}
+
+	for _, b := range binds[:th.NumBinds] {
+		addr, err := decodeAddr(b.Family, b.Addr)
+		if err != nil {
+			return Table{}, err
+		}
+
+		prefix, err := addr.Prefix(int(b.Bits))
+		if err != nil {
+			return Table{}, err
+		}
+
+		t.Binds = append(t.Binds, Bind{Prefix: prefix, PortStart: b.PortStart, PortEnd: b.PortEnd, Proto: b.Proto})
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, t.Entries); err != nil {
+		return Table{}, err
+	}
+
+	for i, e := range t.Entries {
+		if e.Primary >= th.NumBackends || e.Secondary >= th.NumBackends {
+			return Table{}, fmt.Errorf("entry %v references a missing backend", i)
+		}
+	}
+
+	return t, nil
+}
+
+func checkLimits(c Config) error {
+	if c.TableEntries == 0 || c.TableEntries&(c.TableEntries-1) != 0 || c.TableEntries > MaxTableEntries {
+		return fmt.Errorf("table entries must be a power of two up to %v: %v", MaxTableEntries, c.TableEntries)
+	}
+
+	if c.MaxBackends > DefaultMaxBackends || c.MaxBinds > DefaultMaxBinds {
+		return fmt.Errorf("max backends or binds too large: %v, %v", c.MaxBackends, c.MaxBinds)
+	}
+
+	return nil
+}
+
+// tableBytes is the encoded size of every table in the config
+func tableBytes(c Config) uint64 {
+	return tableHeaderBytes +
+		uint64(c.MaxBackends)*backendBytes +
+		uint64(c.MaxBinds)*bindBytes +
+		uint64(c.TableEntries)*entryBytes
+}
+
+func encodeAddr(addr netip.Addr) (uint32, [addrBytes]byte, error) {
+	var out [addrBytes]byte
+
+	switch {
+	case addr.Is4():
+		a := addr.As4()
+		copy(out[:], a[:])
+		return familyIPv4, out, nil
+	case addr.Is6():
+		return familyIPv6, addr.As16(), nil
+	default:
+		return 0, out, fmt.Errorf("invalid address: %v", addr)
+	}
+}
+
+func decodeAddr(family uint32, data [addrBytes]byte) (netip.Addr, error) {
+	switch family {
+	case familyIPv4:
+		return netip.AddrFrom4([4]byte(data[:4])), nil
+	case familyIPv6:
+		return netip.AddrFrom16(data), nil
+	default:
+		return netip.Addr{}, fmt.Errorf("unknown address family: %v", family)
+	}
+}
@@ -0,0 +1,213 @@
+package glb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"flag"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/joewilliams/rama/pkg/rendezvous"
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "rewrite the fixture files in testdata")
+
+func testConfigs(t *testing.T) map[string]Config {
+	ips := []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("192.0.2.3"),
+		netip.MustParseAddr("2001:db8::1"),
+	}
+
+	table, err := rendezvous.NewWithTableSize(1234567812345678, 64, ips)
+	assert.Nil(t, err)
+
+	binds := []Bind{
+		{Prefix: netip.MustParsePrefix("198.51.100.10/32"), PortStart: 80, PortEnd: 80, Proto: 6},
+		{Prefix: netip.MustParsePrefix("2001:db8:1::/64"), PortStart: 443, PortEnd: 443, Proto: 6},
+	}
+
+	single, err := rendezvous.NewWithTableSize(9999, 16, ips[:1])
+	assert.Nil(t, err)
+
+	drained := FromRendezvous(&single, nil)
+	drained.Backends[0].State = StateDrainingInactive
+	drained.Backends[0].Healthy = false
+
+	return map[string]Config{
+		"forwarding_table.bin": {
+			TableEntries: 64,
+			Tables:       []Table{FromRendezvous(&table, binds)},
+		},
+		"forwarding_table_small.bin": {
+			TableEntries: 16,
+			MaxBackends:  4,
+			MaxBinds:     2,
+			Tables:       []Table{drained, drained},
+		},
+	}
+}
+
+func TestFixtures(t *testing.T) {
+	for name, config := range testConfigs(t) {
+		path := filepath.Join("testdata", name)
+
+		data, err := config.MarshalBinary()
+		assert.Nil(t, err)
+
+		if *update {
+			assert.Nil(t, os.WriteFile(path, data, 0o644))
+		}
+
+		fixture, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(fixture, data), name)
+
+		var decoded Config
+		err = decoded.UnmarshalBinary(fixture)
+		assert.Nil(t, err)
+
+		if config.MaxBackends == 0 {
+			config.MaxBackends = DefaultMaxBackends
+		}
+		if config.MaxBinds == 0 {
+			config.MaxBinds = DefaultMaxBinds
+		}
+
+		assert.Equal(t, config, decoded)
+
+		again, err := decoded.MarshalBinary()
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(fixture, again), name)
+	}
+}
+
+// glb_director.bin.gz is written by testdata/glb_director.c from the packed
+// structs in glb-director rather than by Encode, at the default sizes
+func TestGLBDirectorFixture(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "glb_director.bin.gz"))
+	assert.Nil(t, err)
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+
+	fixture, err := io.ReadAll(gz)
+	assert.Nil(t, err)
+
+	config, err := Decode(bytes.NewReader(fixture))
+	assert.Nil(t, err)
+
+	assert.Equal(t, uint32(MaxTableEntries), config.TableEntries)
+	assert.Equal(t, uint32(DefaultMaxBackends), config.MaxBackends)
+	assert.Equal(t, uint32(DefaultMaxBinds), config.MaxBinds)
+	assert.Equal(t, 1, len(config.Tables))
+
+	table := config.Tables[0]
+	assert.Equal(t, [secureKeyBytes]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}, table.SecureKey)
+	assert.Equal(t, []Backend{
+		{Addr: netip.MustParseAddr("192.0.2.1"), State: StateActive, Healthy: true},
+		{Addr: netip.MustParseAddr("192.0.2.2"), State: StateDrainingInactive, Healthy: false},
+		{Addr: netip.MustParseAddr("2001:db8::1"), State: StateFilling, Healthy: true},
+	}, table.Backends)
+	assert.Equal(t, []Bind{
+		{Prefix: netip.MustParsePrefix("198.51.100.10/32"), PortStart: 80, PortEnd: 80, Proto: 6},
+		{Prefix: netip.MustParsePrefix("2001:db8:1::/64"), PortStart: 443, PortEnd: 443, Proto: 17},
+	}, table.Binds)
+
+	for i, e := range table.Entries {
+		assert.Equal(t, Entry{Primary: uint32(i % 3), Secondary: uint32((i + 1) % 3)}, e)
+	}
+
+	// and it encodes back to exactly what glb-director would read
+	data, err := config.MarshalBinary()
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(fixture, data))
+}
+
+func TestFromRendezvous(t *testing.T) {
+	ips := []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("192.0.2.3"),
+	}
+
+	table, err := rendezvous.NewWithTableSize(1234567812345678, 256, ips)
+	assert.Nil(t, err)
+
+	fwd := FromRendezvous(&table, nil)
+	assert.Equal(t, 256, len(fwd.Entries))
+	assert.Equal(t, ips, []netip.Addr{fwd.Backends[0].Addr, fwd.Backends[1].Addr, fwd.Backends[2].Addr})
+
+	primary, _ := table.Rows()
+	for i, e := range fwd.Entries {
+		assert.Equal(t, primary[i], fwd.Backends[e.Primary].Addr)
+		assert.NotEqual(t, e.Primary, e.Secondary)
+	}
+}
+
+func TestBadEncode(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := Encode(&buf, Config{TableEntries: 100})
+	assert.NotNil(t, err)
+
+	err = Encode(&buf, Config{TableEntries: 2, MaxBackends: 1, Tables: []Table{{
+		Backends: []Backend{{Addr: netip.MustParseAddr("192.0.2.1")}, {Addr: netip.MustParseAddr("192.0.2.2")}},
+		Entries:  make([]Entry, 2),
+	}}})
+	assert.NotNil(t, err)
+
+	err = Encode(&buf, Config{TableEntries: 2, Tables: []Table{{
+		Backends: []Backend{{Addr: netip.MustParseAddr("192.0.2.1")}},
+		Entries:  []Entry{{Primary: 0, Secondary: 1}, {}},
+	}}})
+	assert.NotNil(t, err)
+}
+
+func TestBadDecode(t *testing.T) {
+	_, err := Decode(bytes.NewReader([]byte("not a forwarding table at all")))
+	assert.NotNil(t, err)
+
+	fixture, err := os.ReadFile(filepath.Join("testdata", "forwarding_table_small.bin"))
+	assert.Nil(t, err)
+
+	_, err = Decode(bytes.NewReader(fixture[:len(fixture)-1]))
+	assert.NotNil(t, err)
+
+	_, err = Decode(bytes.NewReader(append(fixture, 0)))
+	assert.NotNil(t, err)
+
+	// header fields are at 8 num tables, 12 table entries, 16 max backends
+	// and 20 max binds
+	corrupt := func(offset int, value uint32) []byte {
+		data := bytes.Clone(fixture)
+		binary.LittleEndian.PutUint32(data[offset:], value)
+		return data
+	}
+
+	for _, data := range [][]byte{
+		corrupt(8, 0xffffffff),
+		corrupt(12, 0x20000),
+		corrupt(12, 0x80000000),
+		corrupt(16, 0x101),
+		corrupt(20, 0xffffffff),
+	} {
+		_, err = Decode(bytes.NewReader(data))
+		assert.NotNil(t, err)
+	}
+
+	// the small fixture has one backend so any other index is missing
+	entries := 24 + tableHeaderBytes + 4*backendBytes + 2*bindBytes
+	_, err = Decode(bytes.NewReader(corrupt(entries, 1)))
+	assert.NotNil(t, err)
+
+	_, err = Decode(bytes.NewReader(corrupt(entries+4, 1)))
+	assert.NotNil(t, err)
+}
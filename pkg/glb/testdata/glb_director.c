@@ -0,0 +1,126 @@
+// writes glb_director.bin.gz's contents to stdout using the packed structs
+// from glb-director's src/glb_fwd_config.h at their default sizes, rather
+// than this package's Encode
+//
+//	cc -o /tmp/glb_director glb_director.c && /tmp/glb_director | gzip -9n > glb_director.bin.gz
+
+#include <arpa/inet.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#define GLB_FMT_MAGIC_WORD 0x44424c47
+#define GLB_FMT_VERSION 2
+#define GLB_FMT_TABLE_ENTRIES 0x10000
+#define GLB_FMT_MAX_NUM_BACKENDS 0x100
+#define GLB_FMT_MAX_NUM_BINDS 0x100
+#define GLB_FMT_SECURE_KEY_BYTES 16
+
+#define FAMILY_IPV4 1
+#define FAMILY_IPV6 2
+
+struct glb_fwd_config_content_table_backend {
+	uint32_t inet_family;
+	union {
+		uint32_t ipv4_addr;
+		uint8_t ipv6_addr[16];
+	};
+	uint16_t state;
+	uint16_t healthy;
+} __attribute__((__packed__));
+
+struct glb_fwd_config_content_table_bind {
+	uint32_t inet_family;
+	union {
+		uint32_t ipv4_addr;
+		uint8_t ipv6_addr[16];
+	};
+	uint16_t ip_bits;
+	uint16_t port_start;
+	uint16_t port_end;
+	uint8_t proto;
+	uint8_t reserved;
+} __attribute__((__packed__));
+
+struct glb_fwd_config_content_table_entry {
+	uint32_t primary;
+	uint32_t secondary;
+} __attribute__((__packed__));
+
+struct glb_fwd_config_content_table {
+	uint32_t num_backends;
+	uint32_t num_binds;
+	uint8_t secure_key[GLB_FMT_SECURE_KEY_BYTES];
+	struct glb_fwd_config_content_table_backend backends[GLB_FMT_MAX_NUM_BACKENDS];
+	struct glb_fwd_config_content_table_bind binds[GLB_FMT_MAX_NUM_BINDS];
+	struct glb_fwd_config_content_table_entry entries[GLB_FMT_TABLE_ENTRIES];
+} __attribute__((__packed__));
+
+struct glb_fwd_config_content {
+	uint32_t magic_word;
+	uint32_t version;
+	uint32_t num_tables;
+	uint32_t table_entries;
+	uint32_t max_num_backends;
+	uint32_t max_num_binds;
+	struct glb_fwd_config_content_table tables[];
+} __attribute__((__packed__));
+
+int main(void) {
+	size_t size = sizeof(struct glb_fwd_config_content) + sizeof(struct glb_fwd_config_content_table);
+	struct glb_fwd_config_content *config = calloc(1, size);
+	struct glb_fwd_config_content_table *table = &config->tables[0];
+
+	config->magic_word = GLB_FMT_MAGIC_WORD;
+	config->version = GLB_FMT_VERSION;
+	config->num_tables = 1;
+	config->table_entries = GLB_FMT_TABLE_ENTRIES;
+	config->max_num_backends = GLB_FMT_MAX_NUM_BACKENDS;
+	config->max_num_binds = GLB_FMT_MAX_NUM_BINDS;
+
+	table->num_backends = 3;
+	table->num_binds = 2;
+	for (int i = 0; i < GLB_FMT_SECURE_KEY_BYTES; i++) {
+		table->secure_key[i] = i;
+	}
+
+	table->backends[0].inet_family = FAMILY_IPV4;
+	inet_pton(AF_INET, "192.0.2.1", &table->backends[0].ipv4_addr);
+	table->backends[0].state = 1;
+	table->backends[0].healthy = 1;
+
+	table->backends[1].inet_family = FAMILY_IPV4;
+	inet_pton(AF_INET, "192.0.2.2", &table->backends[1].ipv4_addr);
+	table->backends[1].state = 2;
+	table->backends[1].healthy = 0;
+
+	table->backends[2].inet_family = FAMILY_IPV6;
+	inet_pton(AF_INET6, "2001:db8::1", table->backends[2].ipv6_addr);
+	table->backends[2].state = 0;
+	table->backends[2].healthy = 1;
+
+	table->binds[0].inet_family = FAMILY_IPV4;
+	inet_pton(AF_INET, "198.51.100.10", &table->binds[0].ipv4_addr);
+	table->binds[0].ip_bits = 32;
+	table->binds[0].port_start = 80;
+	table->binds[0].port_end = 80;
+	table->binds[0].proto = 6;
+
+	table->binds[1].inet_family = FAMILY_IPV6;
+	inet_pton(AF_INET6, "2001:db8:1::", table->binds[1].ipv6_addr);
+	table->binds[1].ip_bits = 64;
+	table->binds[1].port_start = 443;
+	table->binds[1].port_end = 443;
+	table->binds[1].proto = 17;
+
+	for (uint32_t i = 0; i < GLB_FMT_TABLE_ENTRIES; i++) {
+		table->entries[i].primary = i % 3;
+		table->entries[i].secondary = (i + 1) % 3;
+	}
+
+	fwrite(config, size, 1, stdout);
+	free(config);
+
+	return 0;
+}
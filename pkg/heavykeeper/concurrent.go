@@ -0,0 +1,192 @@
+package heavykeeper
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"runtime"
+	"sync"
+
+	"github.com/OneOfOne/xxhash"
+	"golang.org/x/exp/slices"
+)
+
+// ConcurrentTopK is safe for concurrent use. Keys are split across shards
+// by hash and each shard is a TopK behind its own lock, so a key is only
+// ever counted in one shard and the merged top-k is the top-k of all the
+// shard heaps.
+type ConcurrentTopK struct {
+	k      uint32
+	seed   uint64
+	shards []shard
+}
+
+type shard struct {
+	sync.Mutex
+	topk TopK
+	_    [64]byte // pad so neighbouring locks don't share a cache line
+}
+
+// NewConcurrent creates a ConcurrentTopK with shards instances of TopK. The
+// width is split between the shards, rounding up, so memory stays close to
+// a single TopK of the same width and depth. Zero shards uses four per cpu.
+// Like New it panics if decay is not in (0, 1].
+func NewConcurrent(k uint32, width uint64, depth uint32, decay float64, shards int) *ConcurrentTopK {
+	return NewConcurrentWithSeed(k, width, depth, decay, 0, shards)
+}
+
+func NewConcurrentWithSeed(k uint32, width uint64, depth uint32, decay float64, seed uint64, shards int) *ConcurrentTopK {
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(0) * 4
+	}
+
+	c := &ConcurrentTopK{
+		k:      k,
+		seed:   seed,
+		shards: make([]shard, shards),
+	}
+
+	// keys are spread evenly so each shard only needs its share of the width
+	shardWidth := (width + uint64(shards) - 1) / uint64(shards)
+	if shardWidth == 0 {
+		shardWidth = 1
+	}
+
+	// every shard hashes the same but gets its own stream of randomness
+	for i := range c.shards {
+		c.shards[i].topk = NewWithSource(k, shardWidth, depth, decay, seed, rand.NewPCG(seed, uint64(i)))
+	}
+
+	return c
+}
+
+// Shards returns how many shards keys are split across
+func (c *ConcurrentTopK) Shards() int {
+	return len(c.shards)
+}
+
+// SetCanonical sets SetCanonical on every shard
+func (c *ConcurrentTopK) SetCanonical(canonical bool) {
+	for i := range c.shards {
+		c.shards[i].Lock()
+		c.shards[i].topk.SetCanonical(canonical)
+		c.shards[i].Unlock()
+	}
+}
+
+func (c *ConcurrentTopK) AddAddr(addr netip.Addr) {
+	c.AddAddrN(addr, 1)
+}
+
+func (c *ConcurrentTopK) AddAddrN(addr netip.Addr, n uint64) {
+	// As16 maps v4 so both forms of an address land on the same shard
+	addrBytes := addr.As16()
+	s := &c.shards[xxhash.Checksum64S(addrBytes[:], c.seed)%uint64(len(c.shards))]
+
+	s.Lock()
+	s.topk.AddAddrN(addr, n)
+	s.Unlock()
+}
+
+// AddBytes adds data like TopK.AddBytes
+func (c *ConcurrentTopK) AddBytes(data []byte) {
+	c.AddBytesN(data, 1)
+}
+
+func (c *ConcurrentTopK) AddBytesN(data []byte, n uint64) {
+	s := &c.shards[xxhash.Checksum64S(data, c.seed)%uint64(len(c.shards))]
+
+	s.Lock()
+	s.topk.AddBytesN(data, n)
+	s.Unlock()
+}
+
+func (c *ConcurrentTopK) QueryAddr(addr netip.Addr) (uint64, bool) {
+	addrBytes := addr.As16()
+	s := &c.shards[xxhash.Checksum64S(addrBytes[:], c.seed)%uint64(len(c.shards))]
+
+	s.Lock()
+	defer s.Unlock()
+	return s.topk.QueryAddr(addr)
+}
+
+func (c *ConcurrentTopK) QueryBytes(data []byte) (uint64, bool) {
+	s := &c.shards[xxhash.Checksum64S(data, c.seed)%uint64(len(c.shards))]
+
+	s.Lock()
+	defer s.Unlock()
+	return s.topk.QueryBytes(data)
+}
+
+func (c *ConcurrentTopK) GetAddrs() map[netip.Addr]uint64 {
+	output := map[netip.Addr]uint64{}
+	for _, entry := range c.merge() {
+		output[entry.addr] = entry.count
+	}
+
+	return output
+}
+
+func (c *ConcurrentTopK) GetBytes() map[string]uint64 {
+	output := map[string]uint64{}
+	for _, entry := range c.merge() {
+		output[string(entry.data)] = entry.count
+	}
+
+	return output
+}
+
+// RankAddrs returns the merged top-k sorted by count
+func (c *ConcurrentTopK) RankAddrs() ([]netip.Addr, []uint64) {
+	merged := c.merge()
+	listAddrs := make([]netip.Addr, len(merged))
+	listCounts := make([]uint64, len(merged))
+	for i, entry := range merged {
+		listAddrs[i] = entry.addr
+		listCounts[i] = entry.count
+	}
+
+	return listAddrs, listCounts
+}
+
+func (c *ConcurrentTopK) RankBytes() ([][]byte, []uint64) {
+	merged := c.merge()
+	listBytes := make([][]byte, len(merged))
+	listCounts := make([]uint64, len(merged))
+	for i, entry := range merged {
+		listBytes[i] = entry.data
+		listCounts[i] = entry.count
+	}
+
+	return listBytes, listCounts
+}
+
+// merge copies every shard heap and keeps the k largest
+func (c *ConcurrentTopK) merge() nodes {
+	merged := nodes{}
+	for i := range c.shards {
+		c.shards[i].Lock()
+		merged = append(merged, c.shards[i].topk.minHeap.nodes...)
+		c.shards[i].Unlock()
+	}
+
+	slices.SortFunc(merged, func(a node, b node) int {
+		switch {
+		case less(b, a):
+			return -1
+		case less(a, b):
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	if uint32(len(merged)) > c.k {
+		merged = merged[:c.k]
+	}
+
+	return merged
+}
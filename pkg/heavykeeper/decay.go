@@ -0,0 +1,147 @@
+package heavykeeper
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// the chance of decaying a bucket is decay^count. rather than math.Pow on
+// every collision the chances are precomputed as thresholds for the low 53
+// bits of a random uint64, the same bits rand.Float64 uses, so a decision
+// is an integer compare and matches rng.Float64() < math.Pow(decay, count)
+// exactly for the same random stream
+
+const (
+	decayBits = 53
+	decayMask = 1<<decayBits - 1
+
+	// largest table to keep per decay, decays very close to one need
+	// more than this and fall back to math.Pow past the end
+	maxDecayTable = 4096
+)
+
+// tables are only read once built so every instance, shard and window
+// slice with the same decay shares one
+var decayTables sync.Map // float64 -> decayTableEntry
+
+type decayTableEntry struct {
+	table  []uint64
+	cutoff bool
+}
+
+func validDecay(decay float64) error {
+	// zero never decays, also catches NaN, anything else would decay on
+	// every collision
+	if !(decay >= 0 && decay <= 1) {
+		return fmt.Errorf("invalid decay: %v", decay)
+	}
+	return nil
+}
+
+// sharedDecayTable returns the decay table for decay, building it the
+// first time it is asked for
+func sharedDecayTable(decay float64) ([]uint64, bool) {
+	if entry, ok := decayTables.Load(decay); ok {
+		return entry.(decayTableEntry).table, entry.(decayTableEntry).cutoff
+	}
+
+	table, cutoff := decayTable(decay)
+	entry, _ := decayTables.LoadOrStore(decay, decayTableEntry{table: table, cutoff: cutoff})
+	return entry.(decayTableEntry).table, entry.(decayTableEntry).cutoff
+}
+
+// decayTable returns the threshold for every count until the chance drops
+// below 1 in 2^53 and whether it got that far
+func decayTable(decay float64) ([]uint64, bool) {
+	table := []uint64{}
+	for count := 0; count < maxDecayTable; count++ {
+		p := math.Pow(decay, float64(count))
+		if p*(1<<decayBits) < 1 {
+			return table, true
+		}
+		table = append(table, decayThreshold(p))
+	}
+
+	return table, false
+}
+
+func decayThreshold(p float64) uint64 {
+	// x/2^53 < p is the same as x < ceil(p*2^53) for whole x
+	threshold := math.Ceil(p * (1 << decayBits))
+	if threshold > 1<<decayBits {
+		return 1 << decayBits
+	}
+	return uint64(threshold)
+}
+
+func (t *TopK) shouldDecay(count uint64) bool {
+	if count < uint64(len(t.decayTable)) {
+		return t.rng.Uint64()&decayMask < t.decayTable[count]
+	}
+
+	// past the cutoff the chance is effectively zero but still draw so
+	// the random stream is the same as comparing with math.Pow
+	if t.decayCutoff {
+		t.rng.Uint64()
+		return false
+	}
+
+	return t.rng.Uint64()&decayMask < decayThreshold(math.Pow(t.decay, float64(count)))
+}
+
+func (t *TopK) decayChance(count uint64) float64 {
+	if count < uint64(len(t.decayTable)) {
+		return float64(t.decayTable[count]) / (1 << decayBits)
+	}
+
+	if t.decayCutoff {
+		return 0
+	}
+
+	return math.Pow(t.decay, float64(count))
+}
+
+// decayN runs n decay trials against a bucket with count, one per unit,
+// and returns the count left or, once it reached zero, how many units
+// took the bucket over including the one that emptied it. rather than a
+// trial per unit the trials until the next decay are drawn from a
+// geometric distribution so large adds stay cheap, a single unit uses
+// shouldDecay so it matches adding one at a time
+func (t *TopK) decayN(count uint64, n uint64) (uint64, uint64) {
+	if n == 1 {
+		if t.shouldDecay(count) {
+			count--
+		}
+		if count == 0 {
+			return 0, 1
+		}
+		return count, 0
+	}
+
+	for count > 0 && n > 0 {
+		p := t.decayChance(count)
+		if p <= 0 {
+			break
+		}
+
+		// trials up to and including the first decay
+		trials := 1.0
+		if p < 1 {
+			trials = math.Floor(math.Log(1-t.rng.Float64())/math.Log1p(-p)) + 1
+		}
+		if trials > float64(n) {
+			break
+		}
+
+		n = n - uint64(trials)
+		count--
+
+		// the unit that decays the last count takes over the bucket
+		if count == 0 {
+			return 0, n + 1
+		}
+	}
+
+	return count, 0
+}
@@ -1,14 +1,19 @@
 package heavykeeper
 
 import (
+	"bytes"
 	"encoding/binary"
-	"math"
+	"fmt"
 	"math/rand/v2"
 	"net/netip"
 
 	"github.com/OneOfOne/xxhash"
+	"golang.org/x/exp/slices"
 )
 
+// TopK is not safe for concurrent use. Copying a TopK gives a second handle
+// to the same buckets, heap and decay randomness, use Clone for an
+// independent copy.
 type TopK struct {
 	k       uint32
 	width   uint64
@@ -17,6 +22,17 @@ type TopK struct {
 	seed    uint64
 	buckets []nodes
 	minHeap Heap
+	// unmap 4in6 addresses and strip zones before counting
+	canonical bool
+	// decides when to decay, owned by the instance so the same seed and
+	// input give the same result
+	rng *rand.Rand
+	src rand.Source
+	// number of clones seeded from the seed, see cloneSource
+	clones uint64
+	// precomputed decay chances by count, see decay.go
+	decayTable  []uint64
+	decayCutoff bool
 }
 
 type node struct {
@@ -32,16 +48,40 @@ func New(k uint32, width uint64, depth uint32, decay float64) TopK {
 	return NewWtihSeed(k, width, depth, decay, 0)
 }
 
+// NewWtihSeed uses seed for hashing and to seed the decay randomness, zero
+// picks a random seed
 func NewWtihSeed(k uint32, width uint64, depth uint32, decay float64, seed uint64) TopK {
 	if seed == 0 {
 		seed = rand.Uint64()
 	}
 
+	return NewWithSource(k, width, depth, decay, seed, rand.NewPCG(seed, seed))
+}
+
+// NewWithSource uses src for the decay randomness rather than one seeded
+// from seed, e.g. to replay a capture with the same decisions. A nil src
+// is seeded from seed like NewWtihSeed. Every constructor panics if decay
+// is not in [0, 1], zero never decays.
+func NewWithSource(k uint32, width uint64, depth uint32, decay float64, seed uint64, src rand.Source) TopK {
+	if err := validDecay(decay); err != nil {
+		panic(err)
+	}
+
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+
+	if src == nil {
+		src = rand.NewPCG(seed, seed)
+	}
+
 	buckets := make([]nodes, depth)
 	for i := range buckets {
 		buckets[i] = make(nodes, width)
 	}
 
+	table, cutoff := sharedDecayTable(decay)
+
 	t := TopK{
 		k:       k,
 		width:   width,
@@ -50,6 +90,11 @@ func NewWtihSeed(k uint32, width uint64, depth uint32, decay float64, seed uint6
 		buckets: buckets,
 		minHeap: newHeap(k),
 		seed:    seed,
+		rng:     rand.New(src),
+		src:     src,
+
+		decayTable:  table,
+		decayCutoff: cutoff,
 	}
 
 	return t
@@ -74,10 +119,13 @@ func (t *TopK) GetBytes() map[string]uint64 {
 	return output
 }
 
+// RankAddrs returns the entries in the top-k largest first, there are
+// fewer than k until k entries have been seen
 func (t *TopK) RankAddrs() ([]netip.Addr, []uint64) {
-	listAddrs := make([]netip.Addr, t.k)
-	listCounts := make([]uint64, t.k)
-	for i, entry := range t.minHeap.sort() {
+	sorted := t.minHeap.sort()
+	listAddrs := make([]netip.Addr, len(sorted))
+	listCounts := make([]uint64, len(sorted))
+	for i, entry := range sorted {
 		listAddrs[i] = entry.addr
 		listCounts[i] = entry.count
 	}
@@ -86,9 +134,10 @@ func (t *TopK) RankAddrs() ([]netip.Addr, []uint64) {
 }
 
 func (t *TopK) RankBytes() ([][]byte, []uint64) {
-	listBytes := make([][]byte, t.k)
-	listCounts := make([]uint64, t.k)
-	for i, entry := range t.minHeap.sort() {
+	sorted := t.minHeap.sort()
+	listBytes := make([][]byte, len(sorted))
+	listCounts := make([]uint64, len(sorted))
+	for i, entry := range sorted {
 		listBytes[i] = entry.data
 		listCounts[i] = entry.count
 	}
@@ -96,10 +145,30 @@ func (t *TopK) RankBytes() ([][]byte, []uint64) {
 	return listBytes, listCounts
 }
 
+// SetCanonical unmaps IPv4-mapped IPv6 addresses and strips zones in
+// AddAddr so both forms of an address are counted as the same key
+func (t *TopK) SetCanonical(canonical bool) {
+	t.canonical = canonical
+}
+
 func (t *TopK) AddAddr(addr netip.Addr) {
+	t.AddAddrN(addr, 1)
+}
+
+// AddAddrN counts addr n times, e.g. with the bytes in a packet to rank
+// by volume rather than packets
+func (t *TopK) AddAddrN(addr netip.Addr, n uint64) {
+	if n == 0 {
+		return
+	}
+
 	var addrBytes []byte
 	var fingerprint uint64
 
+	if t.canonical {
+		addr = addr.Unmap().WithZone("")
+	}
+
 	idx, exists := t.minHeap.findByAddr(addr)
 
 	// if we've seen this IP before use the fingerprint and []byte we created previously
@@ -111,7 +180,7 @@ func (t *TopK) AddAddr(addr netip.Addr) {
 		fingerprint = t.xxhash(addrBytes)
 	}
 
-	maxCount := t.addWithCount(1, exists, addrBytes, fingerprint)
+	maxCount := t.addWithCount(n, exists, addrBytes, fingerprint)
 
 	if exists {
 		t.minHeap.fix(idx, maxCount)
@@ -126,6 +195,15 @@ func (t *TopK) AddAddr(addr netip.Addr) {
 }
 
 func (t *TopK) AddBytes(data []byte) {
+	t.AddBytesN(data, 1)
+}
+
+// AddBytesN counts data n times
+func (t *TopK) AddBytesN(data []byte, n uint64) {
+	if n == 0 {
+		return
+	}
+
 	var fingerprint uint64
 
 	idx, exists := t.minHeap.findByBytes(data)
@@ -137,19 +215,182 @@ func (t *TopK) AddBytes(data []byte) {
 		fingerprint = t.xxhash(data)
 	}
 
-	maxCount := t.addWithCount(1, exists, data, fingerprint)
+	maxCount := t.addWithCount(n, exists, data, fingerprint)
 
 	if exists {
 		t.minHeap.fix(idx, maxCount)
-	} else {
+	} else if t.minHeap.admits(maxCount) {
+		// keep a copy so callers can reuse their buffer, only for entries
+		// that make it into the heap so other adds don't allocate
 		t.minHeap.add(node{
 			count:       maxCount,
-			data:        data,
+			data:        bytes.Clone(data),
 			fingerprint: fingerprint,
 		})
 	}
 }
 
+// QueryAddr returns the estimated count of any address and whether it is
+// currently in the top-k. Addresses in the top-k return the same count as
+// GetAddrs, others the largest matching bucket which is zero if it was
+// never seen or has since been pushed out.
+func (t *TopK) QueryAddr(addr netip.Addr) (uint64, bool) {
+	if t.canonical {
+		addr = addr.Unmap().WithZone("")
+	}
+
+	if idx, exists := t.minHeap.findByAddr(addr); exists {
+		return t.minHeap.get(idx).count, true
+	}
+
+	addrBytes := addr.AsSlice()
+	return t.estimate(addrBytes, t.xxhash(addrBytes)), false
+}
+
+// QueryBytes is QueryAddr for entries added with AddBytes
+func (t *TopK) QueryBytes(data []byte) (uint64, bool) {
+	if idx, exists := t.minHeap.findByBytes(data); exists {
+		return t.minHeap.get(idx).count, true
+	}
+
+	return t.estimate(data, t.xxhash(data)), false
+}
+
+// Merge adds the counts from other into t so t approximates a single
+// instance that saw both streams. Both need the same width, depth and seed
+// so a key hashes to the same buckets in each. Buckets with the same
+// fingerprint are summed and for different fingerprints the larger count
+// wins less the smaller one, like a decay of one by the other. The heap is
+// rebuilt from the candidates in both heaps with counts from the merged
+// buckets.
+func (t *TopK) Merge(other *TopK) error {
+	if other == t {
+		return fmt.Errorf("can't merge with itself")
+	}
+
+	if t.width != other.width || t.depth != other.depth || t.seed != other.seed {
+		return fmt.Errorf("incompatible parameters: width %v/%v, depth %v/%v, seed %v/%v",
+			t.width, other.width, t.depth, other.depth, t.seed, other.seed)
+	}
+
+	for i := range t.buckets {
+		for j := range t.buckets[i] {
+			a := &t.buckets[i][j]
+			b := other.buckets[i][j]
+
+			switch {
+			case b.count == 0:
+			case a.count == 0 || a.fingerprint == b.fingerprint:
+				a.fingerprint = b.fingerprint
+				a.count = a.count + b.count
+			case a.count >= b.count:
+				a.count = a.count - b.count
+			default:
+				a.fingerprint = b.fingerprint
+				a.count = b.count - a.count
+			}
+		}
+	}
+
+	// a key in both heaps is one candidate whose count is at least the
+	// sum of what each heap saw
+	candidates := map[string]node{}
+	for _, heaps := range []nodes{t.minHeap.nodes, other.minHeap.nodes} {
+		for _, entry := range heaps {
+			key := string(entry.data)
+			if entry.addr.IsValid() {
+				key = "addr" + key
+			}
+
+			if existing, ok := candidates[key]; ok {
+				existing.count = existing.count + entry.count
+				candidates[key] = existing
+				continue
+			}
+
+			entry.data = bytes.Clone(entry.data)
+			candidates[key] = entry
+		}
+	}
+
+	t.minHeap = newHeap(t.k)
+	for _, entry := range candidates {
+		entry.count = max(entry.count, t.estimate(entry.data, entry.fingerprint))
+		t.minHeap.add(entry)
+	}
+
+	return nil
+}
+
+// Clone returns an independent copy. The decay randomness is copied rather
+// than drawn from so cloning doesn't change what the original decides and
+// the copy carries on making the same decisions the original would.
+// Sources other than PCG and ChaCha8 can't be copied, those clones get a
+// stream of their own seeded from the seed and the number of clones.
+func (t *TopK) Clone() TopK {
+	c := *t
+
+	c.buckets = make([]nodes, len(t.buckets))
+	for i := range t.buckets {
+		c.buckets[i] = slices.Clone(t.buckets[i])
+	}
+
+	c.minHeap = newHeap(t.k)
+	c.minHeap.nodes = slices.Clone(t.minHeap.nodes)
+	for i := range c.minHeap.nodes {
+		c.minHeap.nodes[i].data = bytes.Clone(c.minHeap.nodes[i].data)
+	}
+	c.minHeap.init()
+
+	c.src = t.cloneSource()
+	c.rng = rand.New(c.src)
+	c.clones = 0
+
+	return c
+}
+
+func (t *TopK) cloneSource() rand.Source {
+	// marshalling a source's state can't fail
+	switch src := t.src.(type) {
+	case *rand.PCG:
+		state, _ := src.MarshalBinary()
+		c := &rand.PCG{}
+		_ = c.UnmarshalBinary(state)
+		return c
+	case *rand.ChaCha8:
+		state, _ := src.MarshalBinary()
+		c := &rand.ChaCha8{}
+		_ = c.UnmarshalBinary(state)
+		return c
+	}
+
+	t.clones++
+	return rand.NewPCG(t.seed, t.clones)
+}
+
+// estimate returns the largest count in the buckets data hashes to that
+// still has its fingerprint
+func (t *TopK) estimate(data []byte, fingerprint uint64) uint64 {
+	bI := make([]byte, 4)
+	var maxCount uint64
+	dataX := make([]byte, 0, len(data)+4)
+
+	for i := uint32(0); i < t.depth; i++ {
+		binary.LittleEndian.PutUint32(bI, i)
+
+		dataX = append(dataX, data...)
+		dataX = append(dataX, bI...)
+		bucket := t.xxhash(dataX) % t.width
+		dataX = dataX[:0]
+
+		if t.buckets[i][bucket].fingerprint == fingerprint {
+			maxCount = max(maxCount, t.buckets[i][bucket].count)
+		}
+	}
+
+	return maxCount
+}
+
 func (t *TopK) addWithCount(add uint64, exists bool, data []byte, fingerprint uint64) uint64 {
 	bI := make([]byte, 4)
 	min := t.minHeap.min()
@@ -179,13 +420,16 @@ func (t *TopK) addWithCount(add uint64, exists bool, data []byte, fingerprint ui
 			continue
 		}
 
-		if rand.Float64() < math.Pow(t.decay, float64(t.buckets[i][bucket].count)) {
-			t.buckets[i][bucket].count = t.buckets[i][bucket].count - add
-			if t.buckets[i][bucket].count == 0 {
-				t.buckets[i][bucket].fingerprint = fingerprint
-				t.buckets[i][bucket].count = t.buckets[i][bucket].count + add
-				maxCount = max(maxCount, add)
-			}
+		// each of the add units gets its own chance to decay the bucket,
+		// units spent decaying it are lost and once it reaches zero the
+		// rest take it over, the same as adding one unit at a time
+		count, left := t.decayN(t.buckets[i][bucket].count, add)
+		if count > 0 {
+			t.buckets[i][bucket].count = count
+		} else {
+			t.buckets[i][bucket].fingerprint = fingerprint
+			t.buckets[i][bucket].count = left
+			maxCount = max(maxCount, left)
 		}
 	}
 
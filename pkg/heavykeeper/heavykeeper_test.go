@@ -1,10 +1,15 @@
 package heavykeeper
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"math"
 	"math/rand/v2"
 	"net/netip"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -48,7 +53,8 @@ func TestSmallIP(t *testing.T) {
 		netip.MustParseAddr("192.0.2.6"),
 	}
 
-	topk := New(5, 10, 5, 0.9)
+	// a fixed seed so the decay is the same on every run
+	topk := NewWtihSeed(5, 10, 5, 0.9, 1234)
 
 	for _, ip := range ips {
 		topk.AddAddr(ip)
@@ -111,7 +117,8 @@ func TestSmallBytes(t *testing.T) {
 		netip.MustParseAddr("192.0.2.6"),
 	}
 
-	topk := New(5, 10, 5, 0.9)
+	// a fixed seed so the decay is the same on every run
+	topk := NewWtihSeed(5, 10, 5, 0.9, 1234)
 
 	for _, ip := range ips {
 		topk.AddBytes(ip.AsSlice())
@@ -244,12 +251,921 @@ func TestLargeBytes(t *testing.T) {
 	}
 }
 
+func TestCanonical(t *testing.T) {
+	topk := New(5, 10, 5, 0.9)
+	topk.SetCanonical(true)
+
+	for i := 0; i < 3; i++ {
+		topk.AddAddr(netip.MustParseAddr("192.0.2.1"))
+		topk.AddAddr(netip.MustParseAddr("::ffff:192.0.2.1"))
+		topk.AddAddr(netip.MustParseAddr("fe80::1%eth0"))
+		topk.AddAddr(netip.MustParseAddr("fe80::1"))
+	}
+
+	get := topk.GetAddrs()
+	assert.Equal(t, 2, len(get))
+	assert.Equal(t, uint64(6), get[netip.MustParseAddr("192.0.2.1")])
+	assert.Equal(t, uint64(6), get[netip.MustParseAddr("fe80::1")])
+
+	// without it the forms are counted separately
+	topk = New(5, 10, 5, 0.9)
+	topk.AddAddr(netip.MustParseAddr("192.0.2.1"))
+	topk.AddAddr(netip.MustParseAddr("::ffff:192.0.2.1"))
+	assert.Equal(t, 2, len(topk.GetAddrs()))
+}
+
+func TestAddN(t *testing.T) {
+	topk := New(3, 100, 5, 0.9)
+
+	// lots of small packets from one address and a few large ones from another
+	for i := 0; i < 100; i++ {
+		topk.AddAddrN(netip.MustParseAddr("192.0.2.1"), 40)
+		if i%10 == 0 {
+			topk.AddAddrN(netip.MustParseAddr("192.0.2.2"), 1500)
+		}
+	}
+	topk.AddAddrN(netip.MustParseAddr("192.0.2.3"), 0)
+
+	addrs, counts := topk.RankAddrs()
+	assert.Equal(t, netip.MustParseAddr("192.0.2.2"), addrs[0])
+	assert.Equal(t, uint64(15000), counts[0])
+	assert.Equal(t, netip.MustParseAddr("192.0.2.1"), addrs[1])
+	assert.Equal(t, uint64(4000), counts[1])
+	assert.Equal(t, 2, len(topk.GetAddrs()))
+
+	bytes := New(3, 100, 5, 0.9)
+	bytes.AddBytesN([]byte("request"), 3)
+	bytes.AddBytesN([]byte("request"), 4)
+	bytes.AddBytesN([]byte("expensive request"), 100)
+	bytes.AddBytesN([]byte("free request"), 0)
+
+	assert.Equal(t, map[string]uint64{"request": 7, "expensive request": 100}, bytes.GetBytes())
+
+	// a single bucket forces every add to collide with the first entry, an
+	// add larger than the bucket count used to wrap it around
+	topk = NewWtihSeed(1, 1, 1, 0.999, 1234)
+	topk.AddAddrN(netip.MustParseAddr("192.0.2.1"), 1)
+
+	var total uint64 = 1
+	for i := 0; i < 100; i++ {
+		topk.AddAddrN(netip.MustParseAddr("192.0.2.2"), 1000)
+		total = total + 1000
+		assert.LessOrEqual(t, topk.buckets[0][0].count, total)
+		checkHeap(t, &topk)
+	}
+
+	get := topk.GetAddrs()
+	assert.Equal(t, 1, len(get))
+	assert.Greater(t, get[netip.MustParseAddr("192.0.2.2")], uint64(0))
+}
+
+func TestAddNContended(t *testing.T) {
+	a := netip.MustParseAddr("192.0.2.1")
+	b := netip.MustParseAddr("192.0.2.2")
+
+	// a single bucket held by a is contended by b, adding b 500 times in
+	// one call should give the same estimates as adding it one at a time
+	estimate := func(topk *TopK) uint64 {
+		if topk.buckets[0][0].fingerprint == topk.xxhash(b.AsSlice()) {
+			return topk.buckets[0][0].count
+		}
+		return 0
+	}
+
+	var once, each uint64
+	runs := 2000
+	for seed := 0; seed < runs; seed++ {
+		n := NewWtihSeed(2, 1, 1, 0.9, uint64(seed))
+		one := NewWtihSeed(2, 1, 1, 0.9, uint64(seed))
+		n.AddAddrN(a, 20)
+		one.AddAddrN(a, 20)
+
+		n.AddAddrN(b, 500)
+		for i := 0; i < 500; i++ {
+			one.AddAddr(b)
+		}
+
+		// units spent decaying a are never counted for b
+		assert.LessOrEqual(t, estimate(&n), uint64(500))
+		assert.LessOrEqual(t, estimate(&one), uint64(500))
+		checkHeap(t, &n)
+
+		once = once + estimate(&n)
+		each = each + estimate(&one)
+	}
+
+	// b needs about 72 units to decay a count of 20 at 0.9
+	assert.InEpsilon(t, float64(each)/float64(runs), float64(once)/float64(runs), 0.02)
+	assert.InDelta(t, 500-72, float64(once)/float64(runs), 5)
+}
+
+func TestBytesAllocs(t *testing.T) {
+	topk := NewWtihSeed(10, 1000, 4, 0.9, 1234)
+	for i := 0; i < 10; i++ {
+		topk.AddBytesN([]byte(fmt.Sprintf("key-%v", i)), uint64(100+i))
+	}
+
+	// adding to the smallest entry moves it down the heap every time so
+	// each add swaps entries in the index
+	assert.Equal(t, float64(0), testing.AllocsPerRun(100, func() {
+		topk.AddBytesN(topk.minHeap.nodes[0].data, 20)
+	}))
+	checkHeap(t, &topk)
+
+	// swapping back and forth leaves the heap as it was
+	assert.Equal(t, float64(0), testing.AllocsPerRun(100, func() {
+		topk.minHeap.Swap(0, 5)
+		topk.minHeap.Swap(0, 5)
+	}))
+	assert.Equal(t, float64(0), testing.AllocsPerRun(100, func() {
+		topk.QueryBytes([]byte("key-3"))
+	}))
+	checkHeap(t, &topk)
+}
+
+func TestBytesReusedBuffer(t *testing.T) {
+	topk := NewWtihSeed(3, 1000, 4, 0.9, 1234)
+
+	// one buffer for every key like a reader filling the same slice
+	buf := make([]byte, 3)
+	for i, key := range []string{"one", "two", "six"} {
+		copy(buf, key)
+		topk.AddBytesN(buf, uint64(10*(i+1)))
+	}
+	copy(buf, "xxx")
+
+	checkHeap(t, &topk)
+	assert.Equal(t, map[string]uint64{"one": 10, "two": 20, "six": 30}, topk.GetBytes())
+
+	count, ok := topk.QueryBytes([]byte("two"))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(20), count)
+
+	// and adds to an entry find it again
+	copy(buf, "one")
+	topk.AddBytesN(buf, 5)
+	checkHeap(t, &topk)
+	assert.Equal(t, map[string]uint64{"one": 15, "two": 20, "six": 30}, topk.GetBytes())
+}
+
+func TestConcurrent(t *testing.T) {
+	testMap := map[string]int{
+		"192.0.2.1":   1000,
+		"192.0.2.2":   5000,
+		"192.0.2.3":   100,
+		"2001:db8::1": 300,
+		"192.0.2.100": 50,
+		"192.0.2.65":  500,
+		"192.0.2.34":  2000,
+	}
+
+	topk := NewConcurrent(5, 1000, 4, 0.9, 0)
+	bytesTopK := NewConcurrent(5, 1000, 4, 0.9, 3)
+
+	// every worker adds its share of every address at the same time
+	workers := 8
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k, v := range testMap {
+				addr := netip.MustParseAddr(k)
+				for i := 0; i < v/workers; i++ {
+					topk.AddAddr(addr)
+					bytesTopK.AddBytes(addr.AsSlice())
+				}
+				// read while writing to give the race detector something
+				topk.RankAddrs()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// a wide table and few keys means no collisions so counts are exact
+	wantRank := []netip.Addr{
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("192.0.2.34"),
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.65"),
+		netip.MustParseAddr("2001:db8::1"),
+	}
+
+	addrs, counts := topk.RankAddrs()
+	assert.Equal(t, wantRank, addrs)
+	for i, addr := range addrs {
+		assert.Equal(t, uint64(testMap[addr.String()]/workers*workers), counts[i])
+	}
+
+	get := topk.GetAddrs()
+	assert.Equal(t, 5, len(get))
+	assert.Equal(t, uint64(5000), get[netip.MustParseAddr("192.0.2.2")])
+
+	rankBytes, counts := bytesTopK.RankBytes()
+	assert.Equal(t, 5, len(rankBytes))
+	for i := range rankBytes {
+		assert.Equal(t, wantRank[i].AsSlice(), rankBytes[i])
+	}
+	assert.Equal(t, uint64(5000), bytesTopK.GetBytes()[string(wantRank[0].AsSlice())])
+
+	// only entries that have been seen are returned
+	topk = NewConcurrent(5, 100, 4, 0.9, 2)
+	topk.SetCanonical(true)
+	topk.AddAddr(netip.MustParseAddr("192.0.2.1"))
+	topk.AddAddr(netip.MustParseAddr("::ffff:192.0.2.1"))
+	addrs, counts = topk.RankAddrs()
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.1")}, addrs)
+	assert.Equal(t, []uint64{2}, counts)
+
+	// the width is split between shards rather than given to each
+	assert.Equal(t, 2, topk.Shards())
+	assert.Equal(t, uint64(50), topk.shards[0].topk.width)
+	assert.Equal(t, uint64(34), NewConcurrent(5, 100, 4, 0.9, 3).shards[2].topk.width)
+	assert.Equal(t, uint64(1), NewConcurrent(5, 2, 4, 0.9, 8).shards[0].topk.width)
+}
+
+func TestMerge(t *testing.T) {
+	testMap := map[string]int{
+		"192.0.2.1":   1000,
+		"192.0.2.2":   5000,
+		"192.0.2.3":   100,
+		"2001:db8::1": 300,
+		"192.0.2.100": 50,
+		"192.0.2.101": 10,
+		"192.0.2.65":  500,
+		"192.0.2.34":  2000,
+		"192.0.2.122": 1200,
+		"192.0.2.113": 800,
+		"192.0.2.21":  8,
+	}
+
+	// this test runs multiple times to attempt to trigger nondeterministic bugs
+	for i := 0; i < 100; i++ {
+		single := NewWtihSeed(5, 30, 10, 0.9, 1234)
+		edges := []TopK{
+			NewWtihSeed(5, 30, 10, 0.9, 1234),
+			NewWtihSeed(5, 30, 10, 0.9, 1234),
+			NewWtihSeed(5, 30, 10, 0.9, 1234),
+		}
+
+		// each edge sees a different slice of the traffic for every address
+		for k, v := range testMap {
+			addr := netip.MustParseAddr(k)
+			for j := 0; j < v; j++ {
+				single.AddAddr(addr)
+				edges[(j+len(k))%len(edges)].AddAddr(addr)
+			}
+		}
+
+		merged := NewWtihSeed(5, 30, 10, 0.9, 1234)
+		for j := range edges {
+			assert.Nil(t, merged.Merge(&edges[j]))
+			checkHeap(t, &merged)
+		}
+
+		want := single.GetAddrs()
+		get := merged.GetAddrs()
+		assert.Equal(t, 5, len(get))
+		for addr, count := range get {
+			p := float64(count) / float64(testMap[addr.String()])
+			assert.GreaterOrEqual(t, p, errorBound)
+			assert.LessOrEqual(t, count, uint64(testMap[addr.String()]))
+		}
+
+		// the biggest talkers are found either way
+		for _, addr := range []string{"192.0.2.2", "192.0.2.34", "192.0.2.122"} {
+			assert.Contains(t, want, netip.MustParseAddr(addr))
+			assert.Contains(t, get, netip.MustParseAddr(addr))
+		}
+	}
+
+	// bytes merge the same way
+	a := NewWtihSeed(3, 100, 4, 0.9, 1234)
+	b := NewWtihSeed(3, 100, 4, 0.9, 1234)
+	a.AddBytesN([]byte("one"), 10)
+	a.AddBytesN([]byte("two"), 5)
+	b.AddBytesN([]byte("two"), 20)
+	b.AddBytesN([]byte("three"), 1)
+	assert.Nil(t, a.Merge(&b))
+	assert.Equal(t, map[string]uint64{"one": 10, "two": 25, "three": 1}, a.GetBytes())
+
+	other := NewWtihSeed(3, 100, 4, 0.9, 4321)
+	assert.NotNil(t, a.Merge(&other))
+	other = NewWtihSeed(3, 50, 4, 0.9, 1234)
+	assert.NotNil(t, a.Merge(&other))
+	other = NewWtihSeed(3, 100, 5, 0.9, 1234)
+	assert.NotNil(t, a.Merge(&other))
+	assert.NotNil(t, a.Merge(&a))
+	assert.Equal(t, map[string]uint64{"one": 10, "two": 25, "three": 1}, a.GetBytes())
+}
+
+func TestMarshal(t *testing.T) {
+	testMap := map[string]int{
+		"192.0.2.1":    1000,
+		"192.0.2.2":    5000,
+		"192.0.2.3":    100,
+		"2001:db8::1":  300,
+		"fe80::1%eth0": 700,
+		"192.0.2.65":   500,
+	}
+
+	topk := NewWtihSeed(5, 1000, 4, 0.9, 1234)
+	for k, v := range testMap {
+		topk.AddAddrN(netip.MustParseAddr(k), uint64(v))
+	}
+
+	data, err := topk.MarshalBinary()
+	assert.Nil(t, err)
+
+	restored := TopK{}
+	assert.Nil(t, restored.UnmarshalBinary(data))
+	checkHeap(t, &restored)
+	assert.Equal(t, topk.buckets, restored.buckets)
+	assert.Equal(t, topk.GetAddrs(), restored.GetAddrs())
+	assert.Equal(t, uint64(700), restored.GetAddrs()[netip.MustParseAddr("fe80::1%eth0")])
+
+	// both carry on the same way
+	for _, tk := range []*TopK{&topk, &restored} {
+		tk.AddAddrN(netip.MustParseAddr("192.0.2.3"), 2000)
+		tk.AddAddr(netip.MustParseAddr("192.0.2.1"))
+	}
+	assert.Equal(t, topk.GetAddrs(), restored.GetAddrs())
+	assert.Equal(t, uint64(2100), restored.GetAddrs()[netip.MustParseAddr("192.0.2.3")])
+
+	wantAddrs, wantCounts := topk.RankAddrs()
+	addrs, counts := restored.RankAddrs()
+	assert.Equal(t, wantAddrs, addrs)
+	assert.Equal(t, wantCounts, counts)
+
+	// entries out of heap order are put back in order
+	topk.minHeap.nodes = topk.minHeap.sort()
+	data, err = topk.MarshalBinary()
+	assert.Nil(t, err)
+	restored = TopK{}
+	assert.Nil(t, restored.UnmarshalBinary(data))
+	checkHeap(t, &restored)
+
+	bytesTopK := NewWtihSeed(3, 100, 4, 0.9, 1234)
+	bytesTopK.SetCanonical(true)
+	bytesTopK.AddBytesN([]byte("one"), 10)
+	bytesTopK.AddBytesN([]byte("two"), 5)
+	bytesTopK.AddBytesN([]byte{}, 1)
+
+	data, err = bytesTopK.MarshalBinary()
+	assert.Nil(t, err)
+	restored = TopK{}
+	assert.Nil(t, restored.UnmarshalBinary(data))
+	assert.True(t, restored.canonical)
+	assert.Equal(t, bytesTopK.GetBytes(), restored.GetBytes())
+
+	// an empty key as the very last thing in the snapshot
+	emptyLast := NewWtihSeed(2, 100, 4, 0.9, 1234)
+	emptyLast.AddBytesN([]byte("a"), 1)
+	emptyLast.AddBytesN([]byte{}, 5)
+	assert.Equal(t, []byte{}, emptyLast.minHeap.nodes[len(emptyLast.minHeap.nodes)-1].data)
+
+	emptyData, err := emptyLast.MarshalBinary()
+	assert.Nil(t, err)
+	emptyRestored := TopK{}
+	assert.Nil(t, emptyRestored.UnmarshalBinary(emptyData))
+	checkHeap(t, &emptyRestored)
+	assert.Equal(t, map[string]uint64{"a": 1, "": 5}, emptyRestored.GetBytes())
+
+	// every truncation fails and leaves the target alone
+	for i := 0; i < len(data); i++ {
+		assert.NotNil(t, restored.UnmarshalBinary(data[:i]))
+	}
+	assert.NotNil(t, restored.UnmarshalBinary(append(bytes.Clone(data), 0)))
+	assert.Equal(t, bytesTopK.GetBytes(), restored.GetBytes())
+
+	bad := bytes.Clone(data)
+	bad[4] = 2
+	assert.NotNil(t, restored.UnmarshalBinary(bad))
+
+	bad = bytes.Clone(data)
+	bad[0] = 0
+	assert.NotNil(t, restored.UnmarshalBinary(bad))
+
+	// claims far more buckets than there are
+	bad = bytes.Clone(data)
+	binary.LittleEndian.PutUint64(bad[16:24], 1<<40)
+	assert.NotNil(t, restored.UnmarshalBinary(bad))
+
+	for _, decay := range []float64{-0.5, 1.5, math.NaN(), math.Inf(1)} {
+		bad = bytes.Clone(data)
+		binary.LittleEndian.PutUint64(bad[24:32], math.Float64bits(decay))
+		assert.NotNil(t, restored.UnmarshalBinary(bad))
+	}
+
+	// duplicate entries would leave the heap index pointing at one of them
+	bytesTopK.minHeap.nodes[1] = bytesTopK.minHeap.nodes[0]
+	data, err = bytesTopK.MarshalBinary()
+	assert.Nil(t, err)
+	assert.NotNil(t, restored.UnmarshalBinary(data))
+
+	topk.minHeap.nodes[1] = topk.minHeap.nodes[0]
+	data, err = topk.MarshalBinary()
+	assert.Nil(t, err)
+	assert.NotNil(t, restored.UnmarshalBinary(data))
+	assert.Equal(t, map[string]uint64{"one": 10, "two": 5, "": 1}, restored.GetBytes())
+}
+
+func TestQuery(t *testing.T) {
+	topk := NewWtihSeed(2, 1000, 4, 0.9, 1234)
+	topk.SetCanonical(true)
+	topk.AddAddrN(netip.MustParseAddr("192.0.2.1"), 1000)
+	topk.AddAddrN(netip.MustParseAddr("192.0.2.2"), 500)
+	topk.AddAddrN(netip.MustParseAddr("203.0.113.9"), 40)
+
+	count, ok := topk.QueryAddr(netip.MustParseAddr("192.0.2.1"))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1000), count)
+
+	// out of the top-k but still in the buckets
+	count, ok = topk.QueryAddr(netip.MustParseAddr("203.0.113.9"))
+	assert.False(t, ok)
+	assert.Equal(t, uint64(40), count)
+
+	count, ok = topk.QueryAddr(netip.MustParseAddr("::ffff:203.0.113.9"))
+	assert.False(t, ok)
+	assert.Equal(t, uint64(40), count)
+
+	count, ok = topk.QueryAddr(netip.MustParseAddr("198.51.100.1"))
+	assert.False(t, ok)
+	assert.Equal(t, uint64(0), count)
+
+	bytesTopK := NewWtihSeed(1, 1000, 4, 0.9, 1234)
+	bytesTopK.AddBytesN([]byte("one"), 10)
+	bytesTopK.AddBytesN([]byte("two"), 5)
+
+	count, ok = bytesTopK.QueryBytes([]byte("one"))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(10), count)
+
+	count, ok = bytesTopK.QueryBytes([]byte("two"))
+	assert.False(t, ok)
+	assert.Equal(t, uint64(5), count)
+
+	count, ok = bytesTopK.QueryBytes([]byte("three"))
+	assert.False(t, ok)
+	assert.Equal(t, uint64(0), count)
+
+	concurrent := NewConcurrentWithSeed(1, 1000, 4, 0.9, 1234, 4)
+	concurrent.AddAddrN(netip.MustParseAddr("192.0.2.1"), 1000)
+	concurrent.AddAddrN(netip.MustParseAddr("203.0.113.9"), 40)
+	concurrent.AddBytesN([]byte("one"), 10)
+
+	count, _ = concurrent.QueryAddr(netip.MustParseAddr("203.0.113.9"))
+	assert.Equal(t, uint64(40), count)
+	count, _ = concurrent.QueryBytes([]byte("one"))
+	assert.Equal(t, uint64(10), count)
+}
+
+func TestWindowed(t *testing.T) {
+	now := time.Unix(1800, 0)
+	clock := func() time.Time { return now }
+	a := netip.MustParseAddr("192.0.2.1")
+	b := netip.MustParseAddr("192.0.2.2")
+
+	// a minute in six ten second slices
+	w, err := NewSliding(5, 100, 4, 0.9, time.Minute, 6, clock)
+	assert.Nil(t, err)
+
+	w.AddAddrN(a, 100)
+	now = now.Add(10 * time.Second)
+	w.AddAddrN(b, 50)
+	now = now.Add(45 * time.Second)
+	w.AddAddrN(a, 10)
+
+	assert.Equal(t, map[netip.Addr]uint64{a: 110, b: 50}, w.GetAddrs())
+	addrs, counts := w.RankAddrs()
+	assert.Equal(t, []netip.Addr{a, b}, addrs[:2])
+	assert.Equal(t, []uint64{110, 50}, counts[:2])
+
+	// the first slice falls out of the window
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, map[netip.Addr]uint64{a: 10, b: 50}, w.GetAddrs())
+	count, ok := w.QueryAddr(a)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(10), count)
+
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, map[netip.Addr]uint64{a: 10}, w.GetAddrs())
+	count, ok = w.QueryAddr(b)
+	assert.False(t, ok)
+	assert.Equal(t, uint64(0), count)
+
+	// a clock going backwards still counts
+	now = now.Add(-time.Hour)
+	w.AddAddrN(b, 5)
+	now = now.Add(time.Hour)
+	assert.Equal(t, map[netip.Addr]uint64{a: 10, b: 5}, w.GetAddrs())
+
+	// a long gap clears everything
+	now = now.Add(24 * time.Hour)
+	assert.Equal(t, map[netip.Addr]uint64{}, w.GetAddrs())
+
+	w.AddBytesN([]byte("one"), 3)
+	w.AddBytes([]byte("one"))
+	assert.Equal(t, map[string]uint64{"one": 4}, w.GetBytes())
+	count, ok = w.QueryBytes([]byte("one"))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(4), count)
+	rankBytes, counts := w.RankBytes()
+	assert.Equal(t, []byte("one"), rankBytes[0])
+	assert.Equal(t, uint64(4), counts[0])
+
+	now = time.Unix(1800, 0)
+	w, err = NewTumbling(5, 100, 4, 0.9, time.Minute, clock)
+	assert.Nil(t, err)
+	w.SetCanonical(true)
+
+	w.AddAddrN(a, 100)
+	now = now.Add(59 * time.Second)
+	w.AddAddr(netip.MustParseAddr("::ffff:192.0.2.1"))
+	assert.Equal(t, map[netip.Addr]uint64{a: 101}, w.GetAddrs())
+
+	now = now.Add(time.Second)
+	assert.Equal(t, map[netip.Addr]uint64{}, w.GetAddrs())
+
+	_, err = NewSliding(5, 100, 4, 0.9, time.Minute, 0, nil)
+	assert.NotNil(t, err)
+	_, err = NewSliding(5, 100, 4, 0.9, 5, 6, nil)
+	assert.NotNil(t, err)
+
+	w, err = NewTumbling(5, 100, 4, 0.9, time.Minute, nil)
+	assert.Nil(t, err)
+	w.AddAddr(a)
+	assert.Equal(t, 1, len(w.slices))
+
+	// times before 1970 use the same ring
+	for _, start := range []time.Time{time.Unix(-1, 0), time.Unix(-95, 0), time.Unix(0, math.MinInt64+int64(time.Minute))} {
+		now = start
+		w, err = NewSliding(5, 100, 4, 0.9, time.Minute, 6, clock)
+		assert.Nil(t, err)
+
+		w.AddAddrN(a, 100)
+		now = now.Add(time.Second)
+		w.AddAddrN(b, 50)
+		now = now.Add(40 * time.Second)
+		assert.Equal(t, map[netip.Addr]uint64{a: 100, b: 50}, w.GetAddrs())
+
+		now = now.Add(time.Minute)
+		assert.Equal(t, map[netip.Addr]uint64{}, w.GetAddrs())
+	}
+	assert.Equal(t, 5, w.ring(-1))
+	assert.Equal(t, 0, w.ring(-6))
+	assert.Equal(t, int64(-1), w.epochAt(time.Unix(-1, 0)))
+	// times UnixNano can't cover are clamped to its ends
+	assert.Equal(t, w.epochAt(time.Unix(0, math.MinInt64)), w.epochAt(time.Time{}))
+	assert.Equal(t, w.epochAt(time.Unix(0, math.MaxInt64)), w.epochAt(time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)))
+
+	// the same seed gives the same counts
+	now = time.Unix(1800, 0)
+	seeded := []*WindowedTopK{}
+	for i := 0; i < 2; i++ {
+		w, err = NewSlidingWithSeed(2, 1, 1, 0.9, 1234, time.Minute, 6, clock)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(1234), w.seed)
+		for j := 0; j < 100; j++ {
+			w.AddAddrN(a, 5)
+			w.AddAddrN(b, 3)
+		}
+		seeded = append(seeded, w)
+	}
+	assert.Equal(t, seeded[0].GetAddrs(), seeded[1].GetAddrs())
+
+	w, err = NewTumblingWithSeed(5, 100, 4, 0.9, 1234, time.Minute, clock)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1234), w.seed)
+	assert.Equal(t, 1, len(w.slices))
+
+	// counts and estimates add up across slices
+	w, err = NewSliding(1, 100, 4, 0.9, time.Minute, 6, clock)
+	assert.Nil(t, err)
+	w.AddAddrN(a, 10)
+	now = now.Add(10 * time.Second)
+	w.AddAddrN(b, 8)
+	w.AddAddrN(a, 5)
+	assert.Equal(t, map[netip.Addr]uint64{a: 15}, w.GetAddrs())
+	count, ok = w.QueryAddr(b)
+	assert.False(t, ok)
+	assert.Equal(t, uint64(8), count)
+
+	// queries reuse the top-k until the next add or slice boundary
+	view := w.view
+	w.RankAddrs()
+	assert.Same(t, view, w.view)
+	w.AddAddrN(b, 20)
+	assert.Nil(t, w.view)
+	assert.Equal(t, map[netip.Addr]uint64{b: 28}, w.GetAddrs())
+	view = w.view
+	now = now.Add(10 * time.Second)
+	w.GetAddrs()
+	assert.NotSame(t, view, w.view)
+}
+
+func TestRankInterleaved(t *testing.T) {
+	testMap := map[string]int{
+		"192.0.2.1":   1000,
+		"192.0.2.2":   5000,
+		"192.0.2.3":   100,
+		"2001:db8::1": 300,
+		"192.0.2.100": 50,
+		"192.0.2.65":  500,
+		"192.0.2.34":  2000,
+	}
+
+	stream := []netip.Addr{}
+	for k, v := range testMap {
+		for i := 0; i < v; i++ {
+			stream = append(stream, netip.MustParseAddr(k))
+		}
+	}
+	rand.Shuffle(len(stream), func(i, j int) {
+		stream[i], stream[j] = stream[j], stream[i]
+	})
+
+	// a wide table means no collisions so both see exactly the same counts
+	ranked := NewWtihSeed(5, 1000, 4, 0.9, 1234)
+	plain := NewWtihSeed(5, 1000, 4, 0.9, 1234)
+	rankedBytes := NewWtihSeed(5, 1000, 4, 0.9, 1234)
+
+	for i, addr := range stream {
+		ranked.AddAddr(addr)
+		plain.AddAddr(addr)
+		rankedBytes.AddBytes(addr.AsSlice())
+
+		if i%50 == 0 {
+			addrs, counts := ranked.RankAddrs()
+			assert.Equal(t, len(ranked.minHeap.nodes), len(addrs))
+			for j := 1; j < len(counts); j++ {
+				assert.GreaterOrEqual(t, counts[j-1], counts[j])
+			}
+			rankedBytes.RankBytes()
+
+			checkHeap(t, &ranked)
+			checkHeap(t, &rankedBytes)
+		}
+	}
+
+	assert.Equal(t, plain.GetAddrs(), ranked.GetAddrs())
+	wantAddrs, wantCounts := plain.RankAddrs()
+	addrs, counts := ranked.RankAddrs()
+	assert.Equal(t, wantAddrs, addrs)
+	assert.Equal(t, wantCounts, counts)
+	assert.Equal(t, netip.MustParseAddr("192.0.2.2"), addrs[0])
+	assert.Equal(t, uint64(5000), counts[0])
+
+	// only real entries are returned
+	topk := New(5, 100, 4, 0.9)
+	addrs, counts = topk.RankAddrs()
+	assert.Equal(t, 0, len(addrs))
+	assert.Equal(t, 0, len(counts))
+
+	topk.AddAddr(netip.MustParseAddr("192.0.2.1"))
+	topk.AddBytes([]byte("one"))
+	addrs, counts = topk.RankAddrs()
+	assert.Equal(t, 2, len(addrs))
+	assert.Equal(t, []uint64{1, 1}, counts)
+	rankBytes, _ := topk.RankBytes()
+	assert.Equal(t, 2, len(rankBytes))
+}
+
+func TestDeterministic(t *testing.T) {
+	stream := []netip.Addr{}
+	for i := 0; i < 5000; i++ {
+		stream = append(stream, netip.AddrFrom4([4]byte{192, 0, 2, byte(i % 7 * i % 31)}))
+	}
+
+	// a narrow table so there are lots of collisions and decay
+	run := func(topk TopK) TopK {
+		for _, addr := range stream {
+			topk.AddAddr(addr)
+		}
+		return topk
+	}
+
+	a := run(NewWtihSeed(5, 4, 2, 0.9, 1234))
+	b := run(NewWtihSeed(5, 4, 2, 0.9, 1234))
+	assert.Equal(t, a.buckets, b.buckets)
+	assert.Equal(t, a.GetAddrs(), b.GetAddrs())
+
+	c := run(NewWithSource(5, 4, 2, 0.9, 1234, rand.NewPCG(1, 2)))
+	d := run(NewWithSource(5, 4, 2, 0.9, 1234, rand.NewPCG(1, 2)))
+	assert.Equal(t, c.buckets, d.buckets)
+	assert.Equal(t, c.GetAddrs(), d.GetAddrs())
+
+	// a nil source is seeded from the seed
+	e := run(NewWithSource(5, 4, 2, 0.9, 1234, nil))
+	assert.Equal(t, a.buckets, e.buckets)
+	assert.Equal(t, a.GetAddrs(), e.GetAddrs())
+
+	// clones count on their own and don't share the decay randomness
+	f := a.Clone()
+	assert.Equal(t, a.buckets, f.buckets)
+	assert.Equal(t, a.GetAddrs(), f.GetAddrs())
+	assert.NotSame(t, a.rng, f.rng)
+	checkHeap(t, &f)
+
+	f = run(f)
+	assert.Equal(t, b.buckets, a.buckets)
+	assert.Equal(t, b.GetAddrs(), a.GetAddrs())
+	assert.NotEqual(t, f.buckets, a.buckets)
+	checkHeap(t, &a)
+	checkHeap(t, &f)
+
+	// clones copy the decay randomness so they carry on like the original
+	g, h := a.Clone(), a.Clone()
+	assert.Equal(t, g.rng.Uint64(), h.rng.Uint64())
+	g = run(a.Clone())
+	assert.Equal(t, run(a).buckets, g.buckets)
+
+	// cloning mid-stream leaves the original's decisions alone
+	cloned := NewWtihSeed(5, 4, 2, 0.9, 1234)
+	uncloned := NewWtihSeed(5, 4, 2, 0.9, 1234)
+	for i, addr := range stream {
+		if i == len(stream)/2 {
+			clone := cloned.Clone()
+			run(clone)
+		}
+		cloned.AddAddr(addr)
+		uncloned.AddAddr(addr)
+	}
+	clonedData, err := cloned.MarshalBinary()
+	assert.Nil(t, err)
+	unclonedData, err := uncloned.MarshalBinary()
+	assert.Nil(t, err)
+	assert.Equal(t, unclonedData, clonedData)
+
+	// sources that can't be copied get a stream of their own per clone
+	src := &countingSource{}
+	custom := NewWithSource(5, 4, 2, 0.9, 1234, src)
+	g, h = custom.Clone(), custom.Clone()
+	assert.NotEqual(t, g.rng.Uint64(), h.rng.Uint64())
+	assert.Equal(t, uint64(0), src.n)
+
+	bytesTopK := NewWtihSeed(5, 100, 2, 0.9, 1234)
+	bytesTopK.AddBytesN([]byte("one"), 10)
+	clone := bytesTopK.Clone()
+	clone.AddBytesN([]byte("one"), 5)
+	assert.Equal(t, map[string]uint64{"one": 10}, bytesTopK.GetBytes())
+	assert.Equal(t, map[string]uint64{"one": 15}, clone.GetBytes())
+}
+
+// countingSource is a rand.Source Clone can't copy
+type countingSource struct {
+	n uint64
+}
+
+func (s *countingSource) Uint64() uint64 {
+	s.n++
+	return s.n
+}
+
+func TestDecayTable(t *testing.T) {
+	for _, decay := range []float64{0, 0.1, 0.5, 0.9, 0.99, 0.9999, 1} {
+		topk := NewWithSource(5, 10, 2, decay, 1234, rand.NewPCG(1, 2))
+		rng := rand.New(rand.NewPCG(1, 2))
+		assert.LessOrEqual(t, len(topk.decayTable), maxDecayTable)
+
+		// same random stream so every decision matches math.Pow, past the
+		// cutoff the draw still happens so the stream stays in step
+		for count := uint64(1); count < 20000; count = count + 1 + count/100 {
+			if topk.decayCutoff && count >= uint64(len(topk.decayTable)) {
+				assert.Less(t, math.Pow(decay, float64(count)), 1.0/(1<<53))
+			}
+
+			for i := 0; i < 10; i++ {
+				want := rng.Float64() < math.Pow(decay, float64(count))
+				assert.Equal(t, want, topk.shouldDecay(count), "decay %v count %v", decay, count)
+			}
+		}
+	}
+
+	table, cutoff := decayTable(0.9)
+	assert.True(t, cutoff)
+	assert.Equal(t, 349, len(table))
+	assert.Equal(t, uint64(1<<53), table[0])
+
+	// too close to one to reach the cutoff
+	table, cutoff = decayTable(0.9999)
+	assert.False(t, cutoff)
+	assert.Equal(t, maxDecayTable, len(table))
+
+	// every instance with the same decay shares one table
+	a := NewWtihSeed(5, 10, 2, 0.95, 1)
+	b := NewWtihSeed(5, 10, 2, 0.95, 2)
+	c := NewConcurrent(5, 10, 2, 0.95, 2)
+	assert.Same(t, &a.decayTable[0], &b.decayTable[0])
+	assert.Same(t, &a.decayTable[0], &c.shards[1].topk.decayTable[0])
+
+	// zero never decays
+	table, cutoff = decayTable(0)
+	assert.True(t, cutoff)
+	assert.Equal(t, []uint64{1 << 53}, table)
+	never := NewWtihSeed(5, 1, 1, 0, 1234)
+	never.AddAddrN(netip.MustParseAddr("192.0.2.1"), 10)
+	never.AddAddrN(netip.MustParseAddr("192.0.2.2"), 1000)
+	assert.Equal(t, uint64(10), never.buckets[0][0].count)
+	assert.Equal(t, never.xxhash(netip.MustParseAddr("192.0.2.1").AsSlice()), never.buckets[0][0].fingerprint)
+	_, err := NewSliding(5, 10, 2, 0, time.Minute, 6, nil)
+	assert.Nil(t, err)
+
+	for _, decay := range []float64{-0.5, 1.5, math.NaN(), math.Inf(1)} {
+		assert.Panics(t, func() { New(5, 10, 2, decay) })
+		assert.Panics(t, func() { NewConcurrent(5, 10, 2, decay, 2) })
+		_, err := NewSliding(5, 10, 2, decay, time.Minute, 6, nil)
+		assert.NotNil(t, err)
+	}
+}
+
+func checkHeap(t *testing.T, topk *TopK) {
+	nodes := topk.minHeap.nodes
+	assert.LessOrEqual(t, len(nodes), int(topk.k))
+
+	seen := map[string]bool{}
+	for i := range nodes {
+		// every node is no less than its parent
+		if i > 0 {
+			assert.False(t, nodes.Less(i, (i-1)/2))
+		}
+
+		assert.False(t, seen[string(nodes[i].data)])
+		seen[string(nodes[i].data)] = true
+
+		// the index points back at every node
+		var idx int
+		var ok bool
+		if nodes[i].addr.IsValid() {
+			idx, ok = topk.minHeap.findByAddr(nodes[i].addr)
+		} else {
+			idx, ok = topk.minHeap.findByBytes(nodes[i].data)
+		}
+		assert.True(t, ok)
+		assert.Equal(t, i, idx)
+	}
+	assert.Equal(t, len(nodes), len(topk.minHeap.addrs)+len(topk.minHeap.data))
+}
+
+func FuzzTopK(f *testing.F) {
+	f.Add(uint8(3), []byte{192, 0, 2, 1, 192, 0, 2, 1, 192, 0, 2, 2, 10, 0, 0, 1})
+	f.Add(uint8(1), []byte{1, 1, 1, 1, 2, 2, 2, 2, 1, 1, 1, 1, 3, 3, 3, 3, 1, 1, 1, 1})
+
+	// every 4 bytes of data is added as an address and as bytes
+	f.Fuzz(func(t *testing.T, k uint8, data []byte) {
+		if k == 0 {
+			return
+		}
+
+		addrs := NewWtihSeed(uint32(k), 8, 3, 0.9, 1234)
+		bytes := NewWtihSeed(uint32(k), 8, 3, 0.9, 1234)
+		seen := map[netip.Addr]uint64{}
+
+		for i := 0; i+4 <= len(data); i = i + 4 {
+			addr := netip.AddrFrom4([4]byte(data[i : i+4]))
+			seen[addr]++
+
+			addrs.AddAddr(addr)
+			bytes.AddBytes(data[i : i+4])
+
+			checkHeap(t, &addrs)
+			checkHeap(t, &bytes)
+		}
+
+		get := addrs.GetAddrs()
+		for addr := range get {
+			assert.Greater(t, seen[addr], uint64(0))
+		}
+
+		n := len(addrs.minHeap.nodes)
+		rankAddrs, rankCounts := addrs.RankAddrs()
+		for i := 0; i < n; i++ {
+			assert.Equal(t, get[rankAddrs[i]], rankCounts[i])
+			if i > 0 {
+				assert.GreaterOrEqual(t, rankCounts[i-1], rankCounts[i])
+			}
+		}
+
+		getBytes := bytes.GetBytes()
+		n = len(bytes.minHeap.nodes)
+		rankBytes, rankCounts := bytes.RankBytes()
+		for i := 0; i < n; i++ {
+			assert.Equal(t, getBytes[string(rankBytes[i])], rankCounts[i])
+			if i > 0 {
+				assert.GreaterOrEqual(t, rankCounts[i-1], rankCounts[i])
+			}
+		}
+	})
+}
+
+// many addresses in a narrow table so most adds collide and decay
 func BenchmarkAddIP(b *testing.B) {
-	topk := New(5, 100, 100, 0.99)
-	addr := netip.MustParseAddr(fmt.Sprintf("192.0.2.%v", rand.IntN(255-0)+0))
+	topk := New(5, 64, 4, 0.9)
+	addrs := benchmarkParallelAddrs()
 
 	for n := 0; n < b.N; n++ {
-		topk.AddAddr(addr)
+		topk.AddAddr(addrs[n%len(addrs)])
 	}
 }
 
@@ -281,3 +1197,81 @@ func BenchmarkBytes(b *testing.B) {
 		topk.RankBytes()
 	}
 }
+
+func benchmarkParallelAddrs() []netip.Addr {
+	addrs := make([]netip.Addr, 1024)
+	for i := range addrs {
+		addrs[i] = netip.AddrFrom4([4]byte{192, 0, byte(i >> 8), byte(i)})
+	}
+	return addrs
+}
+
+// BenchmarkConcurrentAddAddr and BenchmarkMutexAddAddr add the same keys
+// from every goroutine with the same total width, the mutex is the baseline
+// ConcurrentTopK has to beat. run with -cpu 1,2,4,8 to see how they scale
+
+func BenchmarkConcurrentAddAddr(b *testing.B) {
+	topk := NewConcurrent(10, 100, 4, 0.99, 0)
+	addrs := benchmarkParallelAddrs()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := rand.IntN(len(addrs))
+		for pb.Next() {
+			topk.AddAddr(addrs[i%len(addrs)])
+			i++
+		}
+	})
+}
+
+func BenchmarkMutexAddAddr(b *testing.B) {
+	var mu sync.Mutex
+	topk := New(10, 100, 4, 0.99)
+	addrs := benchmarkParallelAddrs()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := rand.IntN(len(addrs))
+		for pb.Next() {
+			mu.Lock()
+			topk.AddAddr(addrs[i%len(addrs)])
+			mu.Unlock()
+			i++
+		}
+	})
+}
+
+// adds to entries already in the top-k so the cost is mostly finding them
+func BenchmarkAddIPK(b *testing.B) {
+	for _, k := range []uint32{10, 100, 1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("k=%v", k), func(b *testing.B) {
+			topk := New(k, uint64(k)*4, 4, 0.99)
+			addrs := make([]netip.Addr, k)
+			for i := range addrs {
+				addrs[i] = netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})
+				topk.AddAddr(addrs[i])
+			}
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				topk.AddAddr(addrs[n%len(addrs)])
+			}
+		})
+	}
+}
+
+func BenchmarkAddBytesK(b *testing.B) {
+	for _, k := range []uint32{10, 100, 1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("k=%v", k), func(b *testing.B) {
+			topk := New(k, uint64(k)*4, 4, 0.99)
+			keys := make([][]byte, k)
+			for i := range keys {
+				keys[i] = []byte(fmt.Sprintf("AS%v", i))
+				topk.AddBytes(keys[i])
+			}
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				topk.AddBytes(keys[n%len(keys)])
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package heavykeeper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// snapshots are little endian, a header followed by depth rows of width
+// buckets and then the heap entries each followed by its key
+
+const (
+	MagicWord       = 0x4b54484b // "KHTK"
+	SnapshotVersion = 1
+
+	flagCanonical = 1 << 0
+
+	kindBytes = 0
+	kindAddr  = 1
+)
+
+type snapshotHeader struct {
+	MagicWord  uint32
+	Version    uint32
+	K          uint32
+	Depth      uint32
+	Width      uint64
+	Decay      float64
+	Seed       uint64
+	Flags      uint32
+	NumEntries uint32
+}
+
+type snapshotBucket struct {
+	Fingerprint uint64
+	Count       uint64
+}
+
+type snapshotEntry struct {
+	Count       uint64
+	Fingerprint uint64
+	Kind        uint32
+	Length      uint32
+}
+
+func (t *TopK) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+
+	h := snapshotHeader{
+		MagicWord:  MagicWord,
+		Version:    SnapshotVersion,
+		K:          t.k,
+		Depth:      t.depth,
+		Width:      t.width,
+		Decay:      t.decay,
+		Seed:       t.seed,
+		NumEntries: uint32(len(t.minHeap.nodes)),
+	}
+
+	if t.canonical {
+		h.Flags = h.Flags | flagCanonical
+	}
+
+	if err := binary.Write(&buf, binary.LittleEndian, h); err != nil {
+		return nil, err
+	}
+
+	row := make([]snapshotBucket, t.width)
+	for i := range t.buckets {
+		for j := range t.buckets[i] {
+			row[j] = snapshotBucket{Fingerprint: t.buckets[i][j].fingerprint, Count: t.buckets[i][j].count}
+		}
+
+		if err := binary.Write(&buf, binary.LittleEndian, row); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, entry := range t.minHeap.nodes {
+		e := snapshotEntry{Count: entry.count, Fingerprint: entry.fingerprint, Kind: kindBytes}
+		key := entry.data
+
+		// addresses keep their zone so they are stored in full
+		if entry.addr.IsValid() {
+			var err error
+			key, err = entry.addr.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			e.Kind = kindAddr
+		}
+		e.Length = uint32(len(key))
+
+		if err := binary.Write(&buf, binary.LittleEndian, e); err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary replaces t with the snapshot in data, the decay
+// randomness starts over from the seed
+func (t *TopK) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+
+	var h snapshotHeader
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return err
+	}
+
+	if h.MagicWord != MagicWord {
+		return fmt.Errorf("bad magic word: %#x", h.MagicWord)
+	}
+
+	if h.Version != SnapshotVersion {
+		return fmt.Errorf("unsupported version: %v", h.Version)
+	}
+
+	if h.Width == 0 || h.Depth == 0 {
+		return fmt.Errorf("invalid width or depth: %v, %v", h.Width, h.Depth)
+	}
+
+	// check the buckets are all there before allocating them
+	if h.Width > uint64(r.Len())/16/uint64(h.Depth) {
+		return fmt.Errorf("too few buckets for width %v and depth %v", h.Width, h.Depth)
+	}
+
+	if err := validDecay(h.Decay); err != nil {
+		return err
+	}
+
+	if h.NumEntries > h.K {
+		return fmt.Errorf("more entries than k: %v", h.NumEntries)
+	}
+
+	restored := NewWtihSeed(h.K, h.Width, h.Depth, h.Decay, h.Seed)
+	restored.canonical = h.Flags&flagCanonical != 0
+
+	row := make([]snapshotBucket, h.Width)
+	for i := range restored.buckets {
+		if err := binary.Read(r, binary.LittleEndian, row); err != nil {
+			return err
+		}
+
+		for j := range row {
+			restored.buckets[i][j] = node{fingerprint: row[j].Fingerprint, count: row[j].Count}
+		}
+	}
+
+	for i := uint32(0); i < h.NumEntries; i++ {
+		var e snapshotEntry
+		if err := binary.Read(r, binary.LittleEndian, &e); err != nil {
+			return err
+		}
+
+		if uint64(e.Length) > uint64(r.Len()) {
+			return fmt.Errorf("entry %v is truncated", i)
+		}
+
+		key := make([]byte, e.Length)
+		// ReadFull since Read of an empty key at the end of the input is io.EOF
+		if _, err := io.ReadFull(r, key); err != nil {
+			return err
+		}
+
+		entry := node{count: e.Count, fingerprint: e.Fingerprint, data: key}
+
+		switch e.Kind {
+		case kindBytes:
+		case kindAddr:
+			if err := entry.addr.UnmarshalBinary(key); err != nil || !entry.addr.IsValid() {
+				return fmt.Errorf("entry %v has an invalid address", i)
+			}
+			// the same bytes AddAddr hashes
+			entry.data = entry.addr.AsSlice()
+		default:
+			return fmt.Errorf("entry %v has an unknown kind: %v", i, e.Kind)
+		}
+
+		// the heap index holds one position per key
+		var exists bool
+		if entry.addr.IsValid() {
+			_, exists = restored.minHeap.findByAddr(entry.addr)
+		} else {
+			_, exists = restored.minHeap.findByBytes(entry.data)
+		}
+		if exists {
+			return fmt.Errorf("entry %v is a duplicate", i)
+		}
+
+		restored.minHeap.nodes = append(restored.minHeap.nodes, entry)
+		restored.minHeap.index(len(restored.minHeap.nodes) - 1)
+	}
+
+	if r.Len() != 0 {
+		return fmt.Errorf("%v trailing bytes", r.Len())
+	}
+
+	// don't trust the order of the entries in the snapshot
+	restored.minHeap.init()
+
+	*t = restored
+	return nil
+}
@@ -11,26 +11,48 @@ import (
 type Heap struct {
 	nodes nodes
 	k     uint32
+	// position of every entry in nodes, kept up to date by Swap, Push and
+	// Pop so finding an entry doesn't need a scan. they are keyed by the
+	// entry itself rather than the fingerprint so a hit needs no hashing.
+	// data holds pointers so Swap can move an entry without allocating a
+	// new key string
+	addrs map[netip.Addr]int
+	data  map[string]*int
 }
 
 func newHeap(k uint32) Heap {
-	h := nodes{}
+	h := Heap{k: k, addrs: map[netip.Addr]int{}, data: map[string]*int{}}
 	heap.Init(&h)
-	return Heap{nodes: h, k: k}
+	return h
+}
+
+// init restores the heap and index after nodes was replaced
+func (h *Heap) init() {
+	clear(h.addrs)
+	clear(h.data)
+	for i := range h.nodes {
+		h.index(i)
+	}
+	heap.Init(h)
 }
 
 func (h *Heap) add(val node) {
 	if h.k > uint32(len(h.nodes)) {
-		heap.Push(&h.nodes, val)
+		heap.Push(h, val)
 	} else if val.count > h.nodes[0].count {
-		heap.Push(&h.nodes, val)
-		heap.Pop(&h.nodes)
+		heap.Push(h, val)
+		heap.Pop(h)
 	}
 }
 
+// admits returns whether add would keep an entry with count
+func (h *Heap) admits(count uint64) bool {
+	return h.k > uint32(len(h.nodes)) || count > h.nodes[0].count
+}
+
 func (h *Heap) fix(idx int, count uint64) {
 	h.nodes[idx].count = count
-	heap.Fix(&h.nodes, idx)
+	heap.Fix(h, idx)
 }
 
 func (h *Heap) min() uint64 {
@@ -45,63 +67,92 @@ func (h *Heap) get(i int) node {
 }
 
 func (h *Heap) findByAddr(addr netip.Addr) (int, bool) {
-	for i := range h.nodes {
-		if h.nodes[i].addr == addr {
-			return i, true
-		}
-	}
-	return 0, false
+	i, ok := h.addrs[addr]
+	return i, ok
 }
 
 func (h *Heap) findByBytes(data []byte) (int, bool) {
-	for i := range h.nodes {
-		if bytes.Equal(h.nodes[i].data, data) {
-			return i, true
-		}
+	i, ok := h.data[string(data)]
+	if !ok {
+		return 0, false
+	}
+	return *i, true
+}
+
+func (h *Heap) index(i int) {
+	if h.nodes[i].addr.IsValid() {
+		h.addrs[h.nodes[i].addr] = i
+		return
+	}
+
+	// a lookup with string(data) doesn't allocate but an insert does
+	if idx, ok := h.data[string(h.nodes[i].data)]; ok {
+		*idx = i
+	} else {
+		idx := i
+		h.data[string(h.nodes[i].data)] = &idx
 	}
-	return 0, false
 }
 
+// sort returns a copy of the entries largest first, the heap itself is
+// left alone so it can keep taking adds
 func (h *Heap) sort() nodes {
-	slices.SortFunc(h.nodes, func(a node, b node) int {
-		switch a.count > b.count { // using > to get reverse order
-		case true:
+	sorted := slices.Clone(h.nodes)
+	slices.SortFunc(sorted, func(a node, b node) int {
+		switch {
+		case less(b, a): // reversed to get the largest first
 			return -1
-		case false:
+		case less(a, b):
 			return 1
 		default:
 			return 0
 		}
 	})
-	return h.nodes
+	return sorted
 }
 
 // heap interface
 
-func (n nodes) Len() int {
-	return len(n)
+func (h *Heap) Len() int {
+	return len(h.nodes)
 }
 
-func (n nodes) Less(i, j int) bool {
-	// if we have IPs use those
-	if n[i].addr.IsValid() && n[j].addr.IsValid() {
-		return (n[i].count < n[j].count) || (n[i].count == n[j].count && n[i].addr.Less(n[j].addr))
-	}
-
-	// if we don't use the bytes we have
-	return (n[i].count < n[j].count) || (n[i].count == n[j].count && bytes.Compare(n[i].data, n[j].data) < 0)
+func (h *Heap) Less(i, j int) bool {
+	return less(h.nodes[i], h.nodes[j])
 }
 
-func (n nodes) Swap(i, j int) {
-	n[i], n[j] = n[j], n[i]
+func (h *Heap) Swap(i, j int) {
+	h.nodes[i], h.nodes[j] = h.nodes[j], h.nodes[i]
+	h.index(i)
+	h.index(j)
 }
 
-func (n *nodes) Push(val interface{}) {
-	*n = append(*n, val.(node))
+func (h *Heap) Push(val interface{}) {
+	h.nodes = append(h.nodes, val.(node))
+	h.index(len(h.nodes) - 1)
 }
 
-func (n *nodes) Pop() interface{} {
+func (h *Heap) Pop() interface{} {
 	var val node
-	val, *n = (*n)[len((*n))-1], (*n)[:len((*n))-1]
+	val, h.nodes = h.nodes[len(h.nodes)-1], h.nodes[:len(h.nodes)-1]
+	if val.addr.IsValid() {
+		delete(h.addrs, val.addr)
+	} else {
+		delete(h.data, string(val.data))
+	}
 	return val
 }
+
+func (n nodes) Less(i, j int) bool {
+	return less(n[i], n[j])
+}
+
+func less(a node, b node) bool {
+	// if we have IPs use those
+	if a.addr.IsValid() && b.addr.IsValid() {
+		return (a.count < b.count) || (a.count == b.count && a.addr.Less(b.addr))
+	}
+
+	// if we don't use the bytes we have
+	return (a.count < b.count) || (a.count == b.count && bytes.Compare(a.data, b.data) < 0)
+}
@@ -0,0 +1,335 @@
+package heavykeeper
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/netip"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// WindowedTopK counts over a window of time rather than forever. It keeps a
+// ring of TopK instances that each cover an equal slice of the window, adds
+// go to the slice for the current time and slices that fall out of the
+// window are cleared for reuse. Queries combine the heaps and estimates of
+// the slices rather than merging their buckets so memory is bounded by the
+// number of slices times the size of a TopK. Like TopK it is not safe for
+// concurrent use.
+type WindowedTopK struct {
+	k      uint32
+	width  uint64
+	depth  uint32
+	decay  float64
+	seed   uint64
+	slice  time.Duration
+	now    func() time.Time
+	slices []TopK
+	// index of the slice of time the newest slice covers
+	epoch int64
+	// top-k of the window, nil once an add or a new slice changes it
+	view *windowView
+}
+
+// NewTumbling counts over consecutive windows, everything is cleared when
+// a new window starts. A nil now uses time.Now.
+func NewTumbling(k uint32, width uint64, depth uint32, decay float64, window time.Duration, now func() time.Time) (*WindowedTopK, error) {
+	return NewSlidingWithSeed(k, width, depth, decay, 0, window, 1, now)
+}
+
+// NewTumblingWithSeed is NewTumbling with the seed every slice uses for
+// hashing and decay, zero picks a random seed
+func NewTumblingWithSeed(k uint32, width uint64, depth uint32, decay float64, seed uint64, window time.Duration, now func() time.Time) (*WindowedTopK, error) {
+	return NewSlidingWithSeed(k, width, depth, decay, seed, window, 1, now)
+}
+
+// NewSliding counts over the last window of time, which moves forward
+// every window/slices
+func NewSliding(k uint32, width uint64, depth uint32, decay float64, window time.Duration, slices int, now func() time.Time) (*WindowedTopK, error) {
+	return NewSlidingWithSeed(k, width, depth, decay, 0, window, slices, now)
+}
+
+// NewSlidingWithSeed is NewSliding with the seed every slice uses for
+// hashing and decay, zero picks a random seed
+func NewSlidingWithSeed(k uint32, width uint64, depth uint32, decay float64, seed uint64, window time.Duration, slices int, now func() time.Time) (*WindowedTopK, error) {
+	if err := validDecay(decay); err != nil {
+		return nil, err
+	}
+
+	if slices < 1 {
+		return nil, fmt.Errorf("too few slices: %v", slices)
+	}
+
+	if window < time.Duration(slices) {
+		return nil, fmt.Errorf("window too short: %v", window)
+	}
+
+	if now == nil {
+		now = time.Now
+	}
+
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+
+	w := &WindowedTopK{
+		k:      k,
+		width:  width,
+		depth:  depth,
+		decay:  decay,
+		seed:   seed,
+		slice:  window / time.Duration(slices),
+		now:    now,
+		slices: make([]TopK, slices),
+	}
+
+	// every slice shares a seed so they can be merged
+	for i := range w.slices {
+		w.slices[i] = NewWtihSeed(k, width, depth, decay, w.seed)
+	}
+	w.epoch = w.epochAt(w.now())
+
+	return w, nil
+}
+
+func (w *WindowedTopK) SetCanonical(canonical bool) {
+	for i := range w.slices {
+		w.slices[i].SetCanonical(canonical)
+	}
+}
+
+func (w *WindowedTopK) AddAddr(addr netip.Addr) {
+	w.AddAddrN(addr, 1)
+}
+
+func (w *WindowedTopK) AddAddrN(addr netip.Addr, n uint64) {
+	w.current().AddAddrN(addr, n)
+}
+
+func (w *WindowedTopK) AddBytes(data []byte) {
+	w.AddBytesN(data, 1)
+}
+
+func (w *WindowedTopK) AddBytesN(data []byte, n uint64) {
+	w.current().AddBytesN(data, n)
+}
+
+func (w *WindowedTopK) GetAddrs() map[netip.Addr]uint64 {
+	output := map[netip.Addr]uint64{}
+	for _, entry := range w.top().sorted {
+		output[entry.addr] = entry.count
+	}
+
+	return output
+}
+
+func (w *WindowedTopK) GetBytes() map[string]uint64 {
+	output := map[string]uint64{}
+	for _, entry := range w.top().sorted {
+		output[string(entry.data)] = entry.count
+	}
+
+	return output
+}
+
+func (w *WindowedTopK) RankAddrs() ([]netip.Addr, []uint64) {
+	sorted := w.top().sorted
+	listAddrs := make([]netip.Addr, len(sorted))
+	listCounts := make([]uint64, len(sorted))
+	for i, entry := range sorted {
+		listAddrs[i] = entry.addr
+		listCounts[i] = entry.count
+	}
+
+	return listAddrs, listCounts
+}
+
+func (w *WindowedTopK) RankBytes() ([][]byte, []uint64) {
+	sorted := w.top().sorted
+	listBytes := make([][]byte, len(sorted))
+	listCounts := make([]uint64, len(sorted))
+	for i, entry := range sorted {
+		listBytes[i] = entry.data
+		listCounts[i] = entry.count
+	}
+
+	return listBytes, listCounts
+}
+
+func (w *WindowedTopK) QueryAddr(addr netip.Addr) (uint64, bool) {
+	if w.slices[0].canonical {
+		addr = addr.Unmap().WithZone("")
+	}
+
+	if count, ok := w.top().counts[windowKey{addr: addr}]; ok {
+		return count, true
+	}
+
+	addrBytes := addr.AsSlice()
+	return w.estimate(addrBytes, w.slices[0].xxhash(addrBytes)), false
+}
+
+func (w *WindowedTopK) QueryBytes(data []byte) (uint64, bool) {
+	if count, ok := w.top().counts[windowKey{data: string(data)}]; ok {
+		return count, true
+	}
+
+	return w.estimate(data, w.slices[0].xxhash(data)), false
+}
+
+// current moves the window up to now and returns the newest slice, the
+// caller adds to it so the cached top-k is dropped
+func (w *WindowedTopK) current() *TopK {
+	w.advance()
+	w.view = nil
+	return &w.slices[w.ring(w.epoch)]
+}
+
+func (w *WindowedTopK) advance() {
+	epoch := w.epochAt(w.now())
+
+	// a clock going backwards keeps adding to the newest slice
+	if epoch <= w.epoch {
+		return
+	}
+
+	// only clear each slice once however long it has been
+	start := w.epoch + 1
+	if epoch-start >= int64(len(w.slices)) {
+		start = epoch - int64(len(w.slices)) + 1
+	}
+
+	for e := start; e <= epoch; e++ {
+		w.slices[w.ring(e)].reset()
+	}
+
+	w.epoch = epoch
+	w.view = nil
+}
+
+// UnixNano only covers the years 1678 to 2262
+var (
+	minEpochTime = time.Unix(0, math.MinInt64)
+	maxEpochTime = time.Unix(0, math.MaxInt64)
+)
+
+// epochAt returns the slice of time t falls in, rounding down so times
+// before 1970 don't share a slice with the ones after. Times outside the
+// range UnixNano covers, e.g. the zero time, are clamped to its ends.
+func (w *WindowedTopK) epochAt(t time.Time) int64 {
+	if t.Before(minEpochTime) {
+		t = minEpochTime
+	} else if t.After(maxEpochTime) {
+		t = maxEpochTime
+	}
+
+	nanos := t.UnixNano()
+	epoch := nanos / int64(w.slice)
+	if nanos%int64(w.slice) < 0 {
+		epoch--
+	}
+	return epoch
+}
+
+// ring returns the slice an epoch is counted in, epochs can be negative
+func (w *WindowedTopK) ring(epoch int64) int {
+	i := epoch % int64(len(w.slices))
+	if i < 0 {
+		i = i + int64(len(w.slices))
+	}
+	return int(i)
+}
+
+// windowView is the top-k of the whole window
+type windowView struct {
+	sorted nodes
+	counts map[windowKey]uint64
+}
+
+// top returns the top-k of the window without merging the buckets of the
+// slices. Every entry in a slice heap is a candidate, a key in several
+// heaps counts the sum of what each saw or the sum of its estimates in
+// each slice if that is larger. The result is cached until the next add
+// or slice boundary so repeated queries don't redo the work.
+func (w *WindowedTopK) top() *windowView {
+	w.advance()
+
+	if w.view != nil {
+		return w.view
+	}
+
+	candidates := map[windowKey]node{}
+	for i := range w.slices {
+		for _, entry := range w.slices[i].minHeap.nodes {
+			key := keyOf(entry)
+			if existing, ok := candidates[key]; ok {
+				existing.count = existing.count + entry.count
+				candidates[key] = existing
+				continue
+			}
+
+			candidates[key] = entry
+		}
+	}
+
+	sorted := make(nodes, 0, len(candidates))
+	for _, entry := range candidates {
+		entry.count = max(entry.count, w.estimate(entry.data, entry.fingerprint))
+		sorted = append(sorted, entry)
+	}
+
+	slices.SortFunc(sorted, func(a node, b node) int {
+		switch {
+		case less(b, a):
+			return -1
+		case less(a, b):
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	if uint32(len(sorted)) > w.k {
+		sorted = sorted[:w.k]
+	}
+
+	w.view = &windowView{sorted: sorted, counts: make(map[windowKey]uint64, len(sorted))}
+	for _, entry := range sorted {
+		w.view.counts[keyOf(entry)] = entry.count
+	}
+
+	return w.view
+}
+
+// estimate sums the estimates of every slice, the slices share a seed so
+// data hashes to the same buckets and fingerprint in each
+func (w *WindowedTopK) estimate(data []byte, fingerprint uint64) uint64 {
+	var count uint64
+	for i := range w.slices {
+		count = count + w.slices[i].estimate(data, fingerprint)
+	}
+	return count
+}
+
+// windowKey identifies an entry across slices, addresses keep their zone
+// and aren't confused with bytes entries holding the same bytes
+type windowKey struct {
+	addr netip.Addr
+	data string
+}
+
+func keyOf(entry node) windowKey {
+	if entry.addr.IsValid() {
+		return windowKey{addr: entry.addr}
+	}
+	return windowKey{data: string(entry.data)}
+}
+
+// reset clears the counts without giving up the memory
+func (t *TopK) reset() {
+	for i := range t.buckets {
+		clear(t.buckets[i])
+	}
+	t.minHeap = newHeap(t.k)
+}
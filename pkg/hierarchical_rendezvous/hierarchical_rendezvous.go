@@ -0,0 +1,362 @@
+package hierarchical_rendezvous
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/netip"
+
+	"github.com/OneOfOne/xxhash"
+)
+
+const (
+	// number of table entries * 100 == table size
+	multiple = 100
+)
+
+type member struct {
+	addr    netip.Addr
+	weight  float64
+	healthy bool
+	bytes   []byte
+}
+
+type locality struct {
+	name    string
+	bytes   []byte
+	members []member
+	// the member each row maps to when only looking inside this locality
+	picks []netip.Addr
+	// the member each row maps to for clients in this locality, including spill
+	table []netip.Addr
+}
+
+type Table struct {
+	localities []locality
+	size       uint32
+	key        uint64
+	table      []netip.Addr
+}
+
+func New(key uint64, localities map[string]map[netip.Addr]float64) (Table, error) {
+	count := 0
+	for _, members := range localities {
+		count = count + len(members)
+	}
+
+	return NewWithTableSize(key, uint32(count*int(multiple)), localities)
+}
+
+func NewWithTableSize(key uint64, size uint32, localities map[string]map[netip.Addr]float64) (Table, error) {
+	if size < 1 {
+		return Table{}, fmt.Errorf("table size too small: %v", size)
+	}
+
+	if key == 0 {
+		key = rand.Uint64()
+	}
+
+	locs := make([]locality, 0, len(localities))
+	seen := map[netip.Addr]bool{}
+
+	for name, members := range localities {
+		loc := locality{name: name, bytes: []byte(name)}
+		for addr, weight := range members {
+			if err := checkWeight(weight); err != nil {
+				return Table{}, err
+			}
+
+			if seen[addr] {
+				return Table{}, fmt.Errorf("member in more than one locality: %v", addr)
+			}
+			seen[addr] = true
+
+			loc.members = append(loc.members, member{addr: addr, weight: weight, healthy: true, bytes: addr.AsSlice()})
+		}
+
+		if len(loc.members) > 0 {
+			locs = append(locs, loc)
+		}
+	}
+
+	table := Table{
+		size: size,
+		key:  key,
+	}
+
+	if err := table.update(locs); err != nil {
+		return Table{}, err
+	}
+
+	return table, nil
+}
+
+func (t *Table) Key() uint64 {
+	return t.key
+}
+
+// Get picks a locality weighted by its healthy capacity and then a member
+// within that locality
+func (t *Table) Get(addr netip.Addr) netip.Addr {
+	return t.table[t.xxhash(addr.AsSlice())%uint64(t.size)]
+}
+
+// GetLocal prefers members in the clients own locality, rows only spill to
+// other localities in proportion to the healthy capacity the locality has lost
+func (t *Table) GetLocal(name string, addr netip.Addr) netip.Addr {
+	row := t.xxhash(addr.AsSlice()) % uint64(t.size)
+
+	for l := range t.localities {
+		if t.localities[l].name == name {
+			return t.localities[l].table[row]
+		}
+	}
+
+	return t.table[row]
+}
+
+func (t *Table) Add(name string, addr netip.Addr, weight float64) error {
+	if err := checkWeight(weight); err != nil {
+		return err
+	}
+
+	if _, _, exists := t.find(addr); exists {
+		return fmt.Errorf("member already exists: %v", addr)
+	}
+
+	newLocalities := t.clone()
+	newMember := member{addr: addr, weight: weight, healthy: true, bytes: addr.AsSlice()}
+
+	for l := range newLocalities {
+		if newLocalities[l].name == name {
+			newLocalities[l].members = append(newLocalities[l].members, newMember)
+			return t.update(newLocalities)
+		}
+	}
+
+	newLocalities = append(newLocalities, locality{name: name, bytes: []byte(name), members: []member{newMember}})
+
+	return t.update(newLocalities)
+}
+
+func (t *Table) Delete(addr netip.Addr) error {
+	l, m, exists := t.find(addr)
+	if !exists {
+		return fmt.Errorf("member does not exist: %v", addr)
+	}
+
+	newLocalities := t.clone()
+	members := newLocalities[l].members
+	newLocalities[l].members = append(members[:m:m], members[m+1:]...)
+
+	// drop localities with no members left
+	if len(newLocalities[l].members) == 0 {
+		newLocalities = append(newLocalities[:l:l], newLocalities[l+1:]...)
+	}
+
+	return t.update(newLocalities)
+}
+
+func (t *Table) Set(addr netip.Addr, weight float64) error {
+	if err := checkWeight(weight); err != nil {
+		return err
+	}
+
+	l, m, exists := t.find(addr)
+	if !exists {
+		return fmt.Errorf("member does not exist: %v", addr)
+	}
+
+	newLocalities := t.clone()
+	newLocalities[l].members[m].weight = weight
+
+	return t.update(newLocalities)
+}
+
+// SetHealthy marks a member as healthy or not, unhealthy members keep their
+// weight but receive no rows and reduce the healthy capacity of their locality
+func (t *Table) SetHealthy(addr netip.Addr, healthy bool) error {
+	l, m, exists := t.find(addr)
+	if !exists {
+		return fmt.Errorf("member does not exist: %v", addr)
+	}
+
+	newLocalities := t.clone()
+	newLocalities[l].members[m].healthy = healthy
+
+	return t.update(newLocalities)
+}
+
+// Stats returns the number of rows each member owns in the global table
+func (t *Table) Stats() map[netip.Addr]uint32 {
+	stats := map[netip.Addr]uint32{}
+	for _, loc := range t.localities {
+		for _, member := range loc.members {
+			stats[member.addr] = 0
+		}
+	}
+
+	for _, addr := range t.table {
+		stats[addr]++
+	}
+
+	return stats
+}
+
+func (t *Table) find(addr netip.Addr) (int, int, bool) {
+	for l := range t.localities {
+		for m := range t.localities[l].members {
+			if t.localities[l].members[m].addr == addr {
+				return l, m, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// clone copies the localities and members so a failed update leaves the
+// current table untouched
+func (t *Table) clone() []locality {
+	newLocalities := make([]locality, len(t.localities))
+	for l, loc := range t.localities {
+		newLocalities[l] = locality{name: loc.name, bytes: loc.bytes}
+		newLocalities[l].members = make([]member, len(loc.members))
+		copy(newLocalities[l].members, loc.members)
+	}
+	return newLocalities
+}
+
+func (t *Table) update(localities []locality) error {
+	var healthy float64
+	for _, loc := range localities {
+		healthy = healthy + loc.capacity(true)
+	}
+
+	if healthy <= 0 {
+		return fmt.Errorf("too little healthy capacity: %v", healthy)
+	}
+
+	t.localities = localities
+	t.generateTable()
+
+	return nil
+}
+
+func (t *Table) generateTable() {
+	bI := make([]byte, 4)
+	data := make([]byte, 0, 64)
+	table := make([]netip.Addr, t.size)
+
+	healthy := make([]float64, len(t.localities))
+	for l := range t.localities {
+		healthy[l] = t.localities[l].capacity(true)
+		t.localities[l].picks = make([]netip.Addr, t.size)
+		t.localities[l].table = make([]netip.Addr, t.size)
+	}
+
+	for i := uint32(0); i < t.size; i++ {
+		var highScore float64
+		var highLocality int
+
+		binary.LittleEndian.PutUint32(bI, i)
+
+		for l := range t.localities {
+			loc := &t.localities[l]
+
+			// pick the member within the locality first
+			var highMemberScore float64
+			for _, member := range loc.members {
+				if !member.healthy || member.weight <= 0 {
+					continue
+				}
+
+				data = append(data, member.bytes...)
+				data = append(data, bI...)
+				score := sumToScore(t.xxhash(data), member.weight)
+				data = data[:0]
+
+				if score > highMemberScore {
+					highMemberScore = score
+					loc.picks[i] = member.addr
+				}
+			}
+
+			if healthy[l] <= 0 {
+				continue
+			}
+
+			// then score the locality itself by its healthy capacity
+			data = append(data, loc.bytes...)
+			data = append(data, bI...)
+			score := sumToScore(t.xxhash(data), healthy[l])
+			data = data[:0]
+
+			if score > highScore {
+				highScore = score
+				highLocality = l
+			}
+		}
+
+		table[i] = t.localities[highLocality].picks[i]
+	}
+
+	// rows stay local unless the locality lost enough healthy capacity,
+	// a different seed keeps this independent from the scores above
+	for l := range t.localities {
+		loc := &t.localities[l]
+		ratio := healthy[l] / loc.capacity(false)
+
+		for i := uint32(0); i < t.size; i++ {
+			binary.LittleEndian.PutUint32(bI, i)
+
+			data = append(data, loc.bytes...)
+			data = append(data, bI...)
+			spill := uniform(xxhash.Checksum64S(data, ^t.key))
+			data = data[:0]
+
+			if spill < ratio && loc.picks[i].IsValid() {
+				loc.table[i] = loc.picks[i]
+			} else {
+				loc.table[i] = table[i]
+			}
+		}
+	}
+
+	t.table = table
+}
+
+// capacity is the sum of member weights, optionally only the healthy ones
+func (l *locality) capacity(healthyOnly bool) float64 {
+	var capacity float64
+	for _, member := range l.members {
+		if healthyOnly && !member.healthy {
+			continue
+		}
+		capacity = capacity + member.weight
+	}
+	return capacity
+}
+
+func (t *Table) xxhash(data []byte) uint64 {
+	return xxhash.Checksum64S(data, t.key)
+}
+
+func checkWeight(weight float64) error {
+	if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+		return fmt.Errorf("invalid weight: %v", weight)
+	}
+	return nil
+}
+
+// convert the uint64 sum to a uniformly random float64 in [0, 1)
+func uniform(sum uint64) float64 {
+	return float64(sum>>11) * float64(1.0/9007199254740992.0)
+}
+
+func sumToScore(sum uint64, weight float64) float64 {
+	// same scoring as weighted_rendezvous
+	// https://github.com/golang/go/issues/12290
+	floatSum := float64(sum>>10) * float64(1.0/9007199254740992.0)
+	return math.Abs((1.0 / -math.Log(float64(floatSum))) * weight)
+}
@@ -0,0 +1,303 @@
+package hierarchical_rendezvous
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testLocalities() map[string]map[netip.Addr]float64 {
+	return map[string]map[netip.Addr]float64{
+		"zone-a": {
+			netip.MustParseAddr("192.0.2.1"): 10,
+			netip.MustParseAddr("192.0.2.2"): 10,
+		},
+		"zone-b": {
+			netip.MustParseAddr("198.51.100.1"): 10,
+			netip.MustParseAddr("198.51.100.2"): 10,
+		},
+		"zone-c": {
+			netip.MustParseAddr("203.0.113.1"): 20,
+			netip.MustParseAddr("203.0.113.2"): 20,
+		},
+	}
+}
+
+func zoneOf(localities map[string]map[netip.Addr]float64, addr netip.Addr) string {
+	for name, members := range localities {
+		if _, ok := members[addr]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+func TestNew(t *testing.T) {
+	localities := testLocalities()
+
+	table, err := New(1234567812345678, localities)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 6*multiple, len(table.table))
+
+	counts := map[string]float64{}
+	for _, ip := range table.table {
+		assert.True(t, ip.IsValid())
+		counts[zoneOf(localities, ip)]++
+	}
+
+	// zone-c has half of the capacity
+	assert.InDelta(t, 0.25, counts["zone-a"]/float64(len(table.table)), 0.08)
+	assert.InDelta(t, 0.25, counts["zone-b"]/float64(len(table.table)), 0.08)
+	assert.InDelta(t, 0.50, counts["zone-c"]/float64(len(table.table)), 0.08)
+
+	// with everything healthy clients never leave their locality
+	for name := range localities {
+		for i := 0; i <= 255; i++ {
+			ip := table.GetLocal(name, netip.MustParseAddr(fmt.Sprintf("10.0.0.%v", i)))
+			assert.Equal(t, name, zoneOf(localities, ip))
+		}
+	}
+
+	// unknown localities use the global table
+	lookup := netip.MustParseAddr("10.0.0.1")
+	assert.Equal(t, table.Get(lookup), table.GetLocal("zone-z", lookup))
+}
+
+func TestSpill(t *testing.T) {
+	localities := testLocalities()
+
+	table, err := New(1234567812345678, localities)
+	assert.Nil(t, err)
+
+	// losing half of zone-a should spill around half of its rows
+	err = table.SetHealthy(netip.MustParseAddr("192.0.2.1"), false)
+	assert.Nil(t, err)
+
+	local := 0
+	for l := range table.localities {
+		if table.localities[l].name != "zone-a" {
+			continue
+		}
+
+		for _, ip := range table.localities[l].table {
+			assert.True(t, ip.IsValid())
+			assert.NotEqual(t, netip.MustParseAddr("192.0.2.1"), ip)
+
+			if zoneOf(localities, ip) == "zone-a" {
+				local++
+			}
+		}
+	}
+
+	assert.InDelta(t, 0.5, float64(local)/float64(table.size), 0.1)
+
+	// losing all of zone-a spills everything
+	err = table.SetHealthy(netip.MustParseAddr("192.0.2.2"), false)
+	assert.Nil(t, err)
+
+	for i := 0; i <= 255; i++ {
+		ip := table.GetLocal("zone-a", netip.MustParseAddr(fmt.Sprintf("10.0.0.%v", i)))
+		assert.True(t, ip.IsValid())
+		assert.NotEqual(t, "zone-a", zoneOf(localities, ip))
+	}
+
+	// and it comes back once healthy
+	err = table.SetHealthy(netip.MustParseAddr("192.0.2.1"), true)
+	assert.Nil(t, err)
+	err = table.SetHealthy(netip.MustParseAddr("192.0.2.2"), true)
+	assert.Nil(t, err)
+
+	for i := 0; i <= 255; i++ {
+		ip := table.GetLocal("zone-a", netip.MustParseAddr(fmt.Sprintf("10.0.0.%v", i)))
+		assert.Equal(t, "zone-a", zoneOf(localities, ip))
+	}
+}
+
+func TestDelete(t *testing.T) {
+	localities := testLocalities()
+	toDelete := netip.MustParseAddr("198.51.100.1")
+
+	table, err := New(1234567812345678, localities)
+	assert.Nil(t, err)
+
+	want := map[string]netip.Addr{}
+	wantLocal := map[string]map[string]netip.Addr{}
+
+	for i := 0; i <= 255; i++ {
+		stringIP := fmt.Sprintf("10.0.0.%v", i)
+		want[stringIP] = table.Get(netip.MustParseAddr(stringIP))
+
+		for name := range localities {
+			if wantLocal[name] == nil {
+				wantLocal[name] = map[string]netip.Addr{}
+			}
+			wantLocal[name][stringIP] = table.GetLocal(name, netip.MustParseAddr(stringIP))
+		}
+	}
+
+	err = table.Delete(toDelete)
+	assert.Nil(t, err)
+
+	for _, ip := range table.table {
+		assert.NotEqual(t, toDelete, ip)
+		assert.True(t, ip.IsValid())
+	}
+
+	// only rows that were in zone-b may move
+	for k, v := range want {
+		ip := table.Get(netip.MustParseAddr(k))
+		if zoneOf(localities, v) != "zone-b" {
+			assert.Equal(t, v, ip)
+		}
+	}
+
+	for name, lookups := range wantLocal {
+		for k, v := range lookups {
+			ip := table.GetLocal(name, netip.MustParseAddr(k))
+			if zoneOf(localities, v) != "zone-b" {
+				assert.Equal(t, v, ip)
+			}
+		}
+	}
+}
+
+func TestOtherLocalities(t *testing.T) {
+	localities := testLocalities()
+	zoneB := netip.MustParseAddr("198.51.100.1")
+	// covers the added member too
+	inZoneB := netip.MustParsePrefix("198.51.100.0/24").Contains
+
+	changes := map[string]func(table *Table) error{
+		"heavier":   func(table *Table) error { return table.Set(zoneB, 40) },
+		"lighter":   func(table *Table) error { return table.Set(zoneB, 2) },
+		"unhealthy": func(table *Table) error { return table.SetHealthy(zoneB, false) },
+		"delete":    func(table *Table) error { return table.Delete(zoneB) },
+		"add": func(table *Table) error {
+			return table.Add("zone-b", netip.MustParseAddr("198.51.100.3"), 10)
+		},
+	}
+
+	for name, change := range changes {
+		table, err := New(1234567812345678, localities)
+		assert.Nil(t, err)
+
+		before := append([]netip.Addr{}, table.table...)
+		beforeLocal := map[string][]netip.Addr{}
+		for _, loc := range table.localities {
+			beforeLocal[loc.name] = append([]netip.Addr{}, loc.table...)
+		}
+
+		assert.Nil(t, change(&table), name)
+
+		// a row can move to or from zone-b but a row that stays in another
+		// locality keeps its member
+		moved := 0
+		for i := range table.table {
+			if !inZoneB(before[i]) && !inZoneB(table.table[i]) {
+				assert.Equal(t, before[i], table.table[i], "%v row %v", name, i)
+			}
+			if before[i] != table.table[i] {
+				moved++
+			}
+		}
+		assert.Greater(t, moved, 0, name)
+
+		for _, loc := range table.localities {
+			if loc.name == "zone-b" {
+				continue
+			}
+			for i := range loc.table {
+				if !inZoneB(beforeLocal[loc.name][i]) && !inZoneB(loc.table[i]) {
+					assert.Equal(t, beforeLocal[loc.name][i], loc.table[i], "%v %v row %v", name, loc.name, i)
+				}
+			}
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	table, err := New(1234567812345678, testLocalities())
+	assert.Nil(t, err)
+
+	newMember := netip.MustParseAddr("2001:db8::1")
+	err = table.Add("zone-d", newMember, 20)
+	assert.Nil(t, err)
+
+	err = table.Add("zone-a", newMember, 20)
+	assert.NotNil(t, err)
+
+	stats := table.Stats()
+	assert.Equal(t, 7, len(stats))
+	assert.Greater(t, stats[newMember], uint32(0))
+
+	for i := 0; i <= 255; i++ {
+		ip := table.GetLocal("zone-d", netip.MustParseAddr(fmt.Sprintf("10.0.0.%v", i)))
+		assert.Equal(t, newMember, ip)
+	}
+
+	err = table.Set(newMember, -1)
+	assert.NotNil(t, err)
+
+	err = table.Delete(newMember)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(table.localities))
+
+	// like Set a member has to exist to be deleted
+	err = table.Delete(newMember)
+	assert.NotNil(t, err)
+}
+
+func TestUnhealthy(t *testing.T) {
+	table, err := New(1234567812345678, map[string]map[netip.Addr]float64{
+		"zone-a": {netip.MustParseAddr("192.0.2.1"): 10},
+	})
+	assert.Nil(t, err)
+
+	// the last healthy member can't be removed
+	err = table.SetHealthy(netip.MustParseAddr("192.0.2.1"), false)
+	assert.NotNil(t, err)
+
+	err = table.Delete(netip.MustParseAddr("192.0.2.1"))
+	assert.NotNil(t, err)
+
+	assert.Equal(t, netip.MustParseAddr("192.0.2.1"), table.Get(netip.MustParseAddr("10.0.0.1")))
+}
+
+func TestBadNew(t *testing.T) {
+	_, err := New(0, map[string]map[netip.Addr]float64{})
+	assert.NotNil(t, err)
+
+	_, err = New(0, map[string]map[netip.Addr]float64{
+		"zone-a": {netip.MustParseAddr("192.0.2.1"): 10},
+		"zone-b": {netip.MustParseAddr("192.0.2.1"): 10},
+	})
+	assert.NotNil(t, err)
+}
+
+func BenchmarkGenerate1kEntries(b *testing.B) {
+	localities := map[string]map[netip.Addr]float64{}
+	for z := 1; z <= 4; z++ {
+		name := fmt.Sprintf("zone-%v", z)
+		localities[name] = map[netip.Addr]float64{}
+		for i := 0; i < 250; i++ {
+			localities[name][netip.MustParseAddr(fmt.Sprintf("192.0.%v.%v", z, i))] = 10
+		}
+	}
+
+	for n := 0; n < b.N; n++ {
+		New(1234, localities)
+	}
+}
+
+func BenchmarkGenerateLookup(b *testing.B) {
+	table, _ := New(1234, testLocalities())
+
+	lookupIP := netip.MustParseAddr("192.0.2.4")
+
+	for n := 0; n < b.N; n++ {
+		table.GetLocal("zone-b", lookupIP)
+	}
+}
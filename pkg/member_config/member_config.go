@@ -0,0 +1,381 @@
+package member_config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joewilliams/rama/pkg/rendezvous"
+	"github.com/joewilliams/rama/pkg/weighted_rendezvous"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the file format, Members is used for rendezvous tables and
+// Weights for weighted rendezvous tables. A size of zero uses the default
+type Config struct {
+	Key     uint64                 `json:"key" yaml:"key"`
+	Size    uint32                 `json:"size" yaml:"size"`
+	Members []netip.Addr           `json:"members,omitempty" yaml:"members,omitempty"`
+	Weights map[netip.Addr]float64 `json:"weights,omitempty" yaml:"weights,omitempty"`
+}
+
+// Diff is what a reload changed, Rebuilt is set when the key or size
+// changed and a new table had to be created
+type Diff struct {
+	Added   []netip.Addr
+	Removed []netip.Addr
+	Changed []netip.Addr
+	Rebuilt bool
+}
+
+func (d Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 && !d.Rebuilt
+}
+
+// Load reads a config file, the format is picked by the extension
+func Load(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	return Parse(path, data)
+}
+
+func Parse(path string, data []byte) (Config, error) {
+	var config Config
+
+	switch filepath.Ext(path) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			return Config{}, err
+		}
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&config); err != nil {
+			return Config{}, err
+		}
+	default:
+		return Config{}, fmt.Errorf("unknown config format: %v", path)
+	}
+
+	return config, nil
+}
+
+// Validate checks a config for a rendezvous table
+func (c *Config) Validate() error {
+	if c.Key == 0 {
+		return fmt.Errorf("key must be set so tables are identical between runs")
+	}
+
+	if len(c.Weights) > 0 {
+		return fmt.Errorf("weights are only used by weighted tables")
+	}
+
+	if len(c.Members) < 1 {
+		return fmt.Errorf("too few members: %v", len(c.Members))
+	}
+
+	seen := map[netip.Addr]bool{}
+	for _, addr := range c.Members {
+		if !addr.IsValid() {
+			return fmt.Errorf("invalid member: %v", addr)
+		}
+
+		if seen[addr] {
+			return fmt.Errorf("duplicate member: %v", addr)
+		}
+		seen[addr] = true
+	}
+
+	return nil
+}
+
+// ValidateWeighted checks a config for a weighted rendezvous table
+func (c *Config) ValidateWeighted() error {
+	if c.Key == 0 {
+		return fmt.Errorf("key must be set so tables are identical between runs")
+	}
+
+	if len(c.Members) > 0 {
+		return fmt.Errorf("weighted tables use weights rather than members")
+	}
+
+	active := 0
+	for addr, weight := range c.Weights {
+		if !addr.IsValid() {
+			return fmt.Errorf("invalid member: %v", addr)
+		}
+
+		if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+			return fmt.Errorf("invalid weight for %v: %v", addr, weight)
+		}
+
+		if weight > 0 {
+			active++
+		}
+	}
+
+	if active < 1 {
+		return fmt.Errorf("too few members with positive weight: %v", active)
+	}
+
+	return nil
+}
+
+// the reloaders below poll a config file and apply changes as a single
+// rebuild of a copy of the current table, the copy is swapped in once it
+// is ready so lookups on the table returned by Table never see a partial
+// update. a failed reload keeps serving the last good table. the copy
+// starts from the lookup counts of the current table, lookups made on the
+// current table while the copy is rebuilt are only counted there
+
+// reloadable is what the reloader needs from both rendezvous tables
+type reloadable[T any] interface {
+	*T
+	Clone() T
+	CopyOptions(from *T)
+}
+
+// reloader does the reading, parsing, rebuilding and swapping for both
+// kinds of table, the funcs fill in what differs between them
+type reloader[T any, P reloadable[T]] struct {
+	mu      sync.Mutex
+	path    string
+	current atomic.Pointer[T]
+	config  Config
+	data    []byte
+	err     error
+
+	validate func(config *Config) error
+	// build creates a table for a new key or size
+	build func(config Config) (T, error)
+	// set applies the members of config to a copy of the current table
+	set func(table P, config Config) error
+	// diff fills in the members that changed between two configs
+	diff func(old Config, new Config) Diff
+}
+
+// Table returns the current table, it must not be modified
+func (r *reloader[T, P]) Table() *T {
+	return r.current.Load()
+}
+
+// Config returns the last good config
+func (r *reloader[T, P]) Config() Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.config
+}
+
+// Reload applies the config file if it changed since the last call
+func (r *reloader[T, P]) Reload() (Diff, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return Diff{}, err
+	}
+
+	// unchanged files report the same result as last time
+	if r.data != nil && bytes.Equal(data, r.data) {
+		return Diff{}, r.err
+	}
+	r.data = data
+
+	config, err := Parse(r.path, data)
+	if err == nil {
+		err = r.validate(&config)
+	}
+
+	if err != nil {
+		r.err = fmt.Errorf("reloading %v: %w", r.path, err)
+		return Diff{}, r.err
+	}
+
+	old := r.current.Load()
+	rebuilt := old == nil || config.Key != r.config.Key || config.Size != r.config.Size
+
+	var table T
+	if rebuilt {
+		table, err = r.build(config)
+
+		// a new key or size keeps the options of the current table
+		if err == nil && old != nil {
+			P(&table).CopyOptions(old)
+		}
+	} else {
+		table = P(old).Clone()
+		err = r.set(&table, config)
+	}
+
+	if err != nil {
+		r.err = fmt.Errorf("reloading %v: %w", r.path, err)
+		return Diff{}, r.err
+	}
+
+	diff := r.diff(r.config, config)
+	diff.Rebuilt = rebuilt
+
+	r.current.Store(&table)
+	r.config = config
+	r.err = nil
+
+	return diff, nil
+}
+
+// Watch polls the config file until the context is done, report is called
+// for every change or failed reload
+func (r *reloader[T, P]) Watch(ctx context.Context, interval time.Duration, report func(Diff, error)) {
+	watch(ctx, interval, r.Reload, report)
+}
+
+type Reloader struct {
+	reloader[rendezvous.Table, *rendezvous.Table]
+}
+
+func NewReloader(path string) (*Reloader, error) {
+	r := &Reloader{reloader[rendezvous.Table, *rendezvous.Table]{
+		path:     path,
+		validate: (*Config).Validate,
+		build: func(config Config) (rendezvous.Table, error) {
+			if config.Size == 0 {
+				return rendezvous.New(config.Key, config.Members)
+			}
+			return rendezvous.NewWithTableSize(config.Key, config.Size, config.Members)
+		},
+		set: func(table *rendezvous.Table, config Config) error {
+			return table.SetMembers(config.Members)
+		},
+		diff: func(old Config, new Config) Diff {
+			diff := Diff{}
+			diff.Added, diff.Removed = diffMembers(old.Members, new.Members)
+			return diff
+		},
+	}}
+
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+type WeightedReloader struct {
+	reloader[weighted_rendezvous.Table, *weighted_rendezvous.Table]
+}
+
+func NewWeightedReloader(path string) (*WeightedReloader, error) {
+	r := &WeightedReloader{reloader[weighted_rendezvous.Table, *weighted_rendezvous.Table]{
+		path:     path,
+		validate: (*Config).ValidateWeighted,
+		build: func(config Config) (weighted_rendezvous.Table, error) {
+			if config.Size == 0 {
+				return weighted_rendezvous.New(config.Key, config.Weights)
+			}
+			return weighted_rendezvous.NewWithTableSize(config.Key, config.Size, config.Weights)
+		},
+		set: func(table *weighted_rendezvous.Table, config Config) error {
+			return table.SetMembers(config.Weights)
+		},
+		diff: func(old Config, new Config) Diff {
+			diff := Diff{}
+			diff.Added, diff.Removed = diffMembers(keys(old.Weights), keys(new.Weights))
+			for addr, weight := range new.Weights {
+				if oldWeight, exists := old.Weights[addr]; exists && oldWeight != weight {
+					diff.Changed = append(diff.Changed, addr)
+				}
+			}
+			sortAddrs(diff.Changed)
+			return diff
+		},
+	}}
+
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func watch(ctx context.Context, interval time.Duration, reload func() (Diff, error), report func(Diff, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastErr error
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			diff, err := reload()
+
+			// only report an error once until it changes
+			if err != nil && lastErr != nil && err.Error() == lastErr.Error() {
+				continue
+			}
+			lastErr = err
+
+			if err != nil || !diff.Empty() {
+				report(diff, err)
+			}
+		}
+	}
+}
+
+func diffMembers(old []netip.Addr, new []netip.Addr) ([]netip.Addr, []netip.Addr) {
+	oldSet := make(map[netip.Addr]bool, len(old))
+	for _, addr := range old {
+		oldSet[addr] = true
+	}
+
+	newSet := make(map[netip.Addr]bool, len(new))
+	for _, addr := range new {
+		newSet[addr] = true
+	}
+
+	var added, removed []netip.Addr
+	for addr := range newSet {
+		if !oldSet[addr] {
+			added = append(added, addr)
+		}
+	}
+	for addr := range oldSet {
+		if !newSet[addr] {
+			removed = append(removed, addr)
+		}
+	}
+
+	sortAddrs(added)
+	sortAddrs(removed)
+
+	return added, removed
+}
+
+func keys(weights map[netip.Addr]float64) []netip.Addr {
+	addrs := make([]netip.Addr, 0, len(weights))
+	for addr := range weights {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func sortAddrs(addrs []netip.Addr) {
+	slices.SortFunc(addrs, func(a netip.Addr, b netip.Addr) int {
+		return a.Compare(b)
+	})
+}
@@ -0,0 +1,249 @@
+package member_config
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// write replaces the file atomically so a watcher never sees half of it
+func write(t *testing.T, path string, data string) {
+	tmp := path + ".tmp"
+	assert.Nil(t, os.WriteFile(tmp, []byte(data), 0o644))
+	assert.Nil(t, os.Rename(tmp, path))
+}
+
+func TestParse(t *testing.T) {
+	want := Config{
+		Key:  1234,
+		Size: 1024,
+		Weights: map[netip.Addr]float64{
+			netip.MustParseAddr("192.0.2.1"):   10,
+			netip.MustParseAddr("2001:db8::1"): 20,
+		},
+	}
+
+	config, err := Parse("members.json", []byte(`{"key": 1234, "size": 1024, "weights": {"192.0.2.1": 10, "2001:db8::1": 20}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, want, config)
+	assert.Nil(t, config.ValidateWeighted())
+	assert.NotNil(t, config.Validate())
+
+	config, err = Parse("members.yaml", []byte("key: 1234\nsize: 1024\nweights:\n  192.0.2.1: 10\n  2001:db8::1: 20\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, want, config)
+
+	config, err = Parse("members.yml", []byte("key: 1234\nmembers:\n  - 192.0.2.1\n  - 192.0.2.2\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")}, config.Members)
+	assert.Nil(t, config.Validate())
+
+	_, err = Parse("members.json", []byte(`{"key": 1234, "members": ["192.0.2.300"]}`))
+	assert.NotNil(t, err)
+
+	_, err = Parse("members.json", []byte(`{"key": 1234, "nope": 1}`))
+	assert.NotNil(t, err)
+
+	_, err = Parse("members.toml", []byte(`key = 1234`))
+	assert.NotNil(t, err)
+
+	bad := []Config{
+		{Members: []netip.Addr{netip.MustParseAddr("192.0.2.1")}},
+		{Key: 1},
+		{Key: 1, Members: []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.1")}},
+	}
+	for _, c := range bad {
+		assert.NotNil(t, c.Validate())
+	}
+
+	badWeighted := []Config{
+		{Key: 1, Weights: map[netip.Addr]float64{netip.MustParseAddr("192.0.2.1"): 0}},
+		{Key: 1, Weights: map[netip.Addr]float64{netip.MustParseAddr("192.0.2.1"): -1}},
+	}
+	for _, c := range badWeighted {
+		assert.NotNil(t, c.ValidateWeighted())
+	}
+}
+
+func TestReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "members.yaml")
+	write(t, path, "key: 1234\nsize: 256\nmembers:\n  - 192.0.2.1\n  - 192.0.2.2\n  - 192.0.2.3\n")
+
+	r, err := NewReloader(path)
+	assert.Nil(t, err)
+
+	first := r.Table()
+	lookups := map[netip.Addr]netip.Addr{}
+	for i := 0; i <= 255; i++ {
+		lookup := netip.AddrFrom4([4]byte{198, 51, 100, byte(i)})
+		lookups[lookup] = first.Get(lookup)
+	}
+
+	// nothing changed
+	diff, err := r.Reload()
+	assert.Nil(t, err)
+	assert.True(t, diff.Empty())
+	assert.Equal(t, first, r.Table())
+
+	// membership changes are applied as one rebuild of a copy
+	first.SetMetrics(true)
+	write(t, path, "key: 1234\nsize: 256\nmembers:\n  - 192.0.2.2\n  - 192.0.2.3\n  - 192.0.2.4\n")
+
+	diff, err = r.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, Diff{
+		Added:   []netip.Addr{netip.MustParseAddr("192.0.2.4")},
+		Removed: []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+	}, diff)
+
+	second := r.Table()
+	assert.NotSame(t, first, second)
+	assert.NotNil(t, second.Metrics().Lookups)
+
+	for lookup, owner := range lookups {
+		// the old table is left alone
+		assert.Equal(t, owner, first.Get(lookup))
+
+		got := second.Get(lookup)
+		assert.NotEqual(t, netip.MustParseAddr("192.0.2.1"), got)
+		if owner != netip.MustParseAddr("192.0.2.1") && got != netip.MustParseAddr("192.0.2.4") {
+			assert.Equal(t, owner, got)
+		}
+	}
+
+	// broken files keep the last good table
+	write(t, path, "key: 1234\nsize: 256\nmembers:\n  - 192.0.2.2\n  - 192.0.2.2\n")
+
+	_, err = r.Reload()
+	assert.NotNil(t, err)
+	assert.Same(t, second, r.Table())
+	assert.Equal(t, 3, len(r.Config().Members))
+
+	_, err = r.Reload()
+	assert.NotNil(t, err)
+
+	// key changes need a new table which keeps the options of the old one
+	assert.Nil(t, second.SetAffinity(24, 56))
+	second.SetCanonical(true)
+	second.SetHistory(2)
+	write(t, path, "key: 4321\nsize: 256\nmembers:\n  - 192.0.2.2\n  - 192.0.2.3\n  - 192.0.2.4\n")
+
+	diff, err = r.Reload()
+	assert.Nil(t, err)
+	assert.True(t, diff.Rebuilt)
+
+	third := r.Table()
+	assert.Equal(t, uint64(4321), third.Key())
+	assert.NotNil(t, third.Metrics().Lookups)
+
+	owner := third.Get(netip.MustParseAddr("198.51.100.0"))
+	for i := 0; i <= 255; i++ {
+		assert.Equal(t, owner, third.Get(netip.AddrFrom4([4]byte{198, 51, 100, byte(i)})))
+		assert.Equal(t, owner, third.Get(netip.AddrFrom16([16]byte{10: 0xff, 11: 0xff, 12: 198, 13: 51, 14: 100, 15: byte(i)})))
+	}
+
+	write(t, path, "key: 4321\nsize: 256\nmembers:\n  - 192.0.2.2\n  - 192.0.2.3\n")
+
+	_, err = r.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(r.Table().GetHistory(netip.MustParseAddr("198.51.100.0"))))
+
+	// both forms of a member are one member on a canonical table
+	write(t, path, "key: 4321\nsize: 256\nmembers:\n  - 192.0.2.2\n  - ::ffff:192.0.2.2\n  - 192.0.2.3\n")
+
+	_, err = r.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.2"), netip.MustParseAddr("192.0.2.3")}, r.Table().Members())
+
+	_, err = NewReloader(filepath.Join(t.TempDir(), "missing.json"))
+	assert.NotNil(t, err)
+}
+
+func TestWeightedReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "members.json")
+	write(t, path, `{"key": 1234, "weights": {"192.0.2.1": 10, "192.0.2.2": 20}}`)
+
+	r, err := NewWeightedReloader(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(r.Table().Stats()))
+
+	write(t, path, `{"key": 1234, "weights": {"192.0.2.1": 0, "192.0.2.2": 20, "192.0.2.3": 5}}`)
+
+	diff, err := r.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, Diff{
+		Added:   []netip.Addr{netip.MustParseAddr("192.0.2.3")},
+		Changed: []netip.Addr{netip.MustParseAddr("192.0.2.1")},
+	}, diff)
+
+	stats := r.Table().Stats()
+	assert.Equal(t, 3, len(stats))
+	assert.Equal(t, uint32(0), stats[netip.MustParseAddr("192.0.2.1")])
+
+	// draining everything is refused
+	write(t, path, `{"key": 1234, "weights": {"192.0.2.1": 0}}`)
+
+	_, err = r.Reload()
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, len(r.Table().Stats()))
+
+	// size changes keep the options of the old table
+	assert.Nil(t, r.Table().SetAffinity(24, 56))
+	r.Table().SetMetrics(true)
+	write(t, path, `{"key": 1234, "size": 512, "weights": {"192.0.2.1": 10, "192.0.2.2": 20}}`)
+
+	diff, err = r.Reload()
+	assert.Nil(t, err)
+	assert.True(t, diff.Rebuilt)
+	assert.NotNil(t, r.Table().Metrics().Lookups)
+
+	owner := r.Table().Get(netip.MustParseAddr("198.51.100.0"))
+	for i := 0; i <= 255; i++ {
+		assert.Equal(t, owner, r.Table().Get(netip.AddrFrom4([4]byte{198, 51, 100, byte(i)})))
+	}
+
+	// colliding forms of a member on a canonical table keep the largest weight
+	r.Table().SetCanonical(true)
+	write(t, path, `{"key": 1234, "size": 512, "weights": {"192.0.2.1": 10, "::ffff:192.0.2.1": 30, "192.0.2.2": 20}}`)
+
+	_, err = r.Reload()
+	assert.Nil(t, err)
+	stats = r.Table().Stats()
+	assert.Equal(t, 2, len(stats))
+	assert.Greater(t, stats[netip.MustParseAddr("192.0.2.1")], stats[netip.MustParseAddr("192.0.2.2")])
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "members.json")
+	write(t, path, `{"key": 1234, "members": ["192.0.2.1"]}`)
+
+	r, err := NewReloader(path)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reports := make(chan error, 10)
+
+	done := make(chan bool)
+	go func() {
+		r.Watch(ctx, time.Millisecond, func(diff Diff, err error) {
+			reports <- err
+		})
+		done <- true
+	}()
+
+	write(t, path, `{"key": 1234, "members": ["192.0.2.1", "192.0.2.2"]}`)
+	assert.Nil(t, <-reports)
+	assert.Equal(t, 2, len(r.Table().Members()))
+
+	write(t, path, `{"key": 1234, "members": []}`)
+	assert.NotNil(t, <-reports)
+	assert.Equal(t, 2, len(r.Table().Members()))
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,236 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// each member gets this many counters so concurrent lookups hitting
+	// the same member mostly land on different cache lines
+	shards = 8
+)
+
+// counter is one members lookup count
+type counter [shards]struct {
+	atomic.Uint64
+	_ [56]byte // pad to a cache line
+}
+
+// inc adds to a random shard rather than one picked by row, so lookups of
+// the same row from different goroutines spread out too. the top level
+// math/rand functions use a per thread generator and never lock
+func (c *counter) inc() {
+	c[rand.Uint32()%shards].Add(1)
+}
+
+// load sums the shards
+func (c *counter) load() uint64 {
+	var total uint64
+	for i := range c {
+		total = total + c[i].Load()
+	}
+	return total
+}
+
+// Recorder keeps the per member lookup counters and rebuild times of a
+// table. A member keeps the same counter across rebuilds so its count is
+// carried over without a copy that could miss lookups. Like Get, Inc is
+// safe for concurrent use but not alongside changes to the table
+type Recorder struct {
+	// nil when lookups aren't counted
+	counters map[netip.Addr]*counter
+	// the counter of the owner of every row, rows without an owner share
+	// unowned which is never reported
+	owners  []*counter
+	unowned *counter
+	// time spent generating the table
+	rebuilds    uint64
+	rebuildTime time.Duration
+	lastRebuild time.Duration
+}
+
+// SetLookups turns lookup counters on or off for a table with the given
+// members and rows, when off Inc does no extra work
+func (r *Recorder) SetLookups(enabled bool, members []netip.Addr, table []netip.Addr) {
+	if !enabled {
+		r.counters = nil
+		r.owners = nil
+		return
+	}
+
+	if r.counters == nil {
+		r.mapRows(members, table)
+	}
+}
+
+// Enabled reports whether lookups are counted
+func (r *Recorder) Enabled() bool {
+	return r.counters != nil
+}
+
+// Clone returns a copy with counters of its own that start from the
+// current counts, so lookups on one are never counted by the other
+func (r *Recorder) Clone() Recorder {
+	clone := *r
+	if r.counters == nil {
+		return clone
+	}
+
+	copies := make(map[*counter]*counter, len(r.counters)+1)
+	copies[r.unowned] = &counter{}
+
+	clone.counters = make(map[netip.Addr]*counter, len(r.counters))
+	for addr, c := range r.counters {
+		copied := &counter{}
+		copied[0].Store(c.load())
+		copies[c] = copied
+		clone.counters[addr] = copied
+	}
+
+	clone.unowned = copies[r.unowned]
+	clone.owners = make([]*counter, len(r.owners))
+	for i, c := range r.owners {
+		clone.owners[i] = copies[c]
+	}
+
+	return clone
+}
+
+// Inc counts a lookup of a row
+func (r *Recorder) Inc(row uint64) {
+	if r.owners != nil {
+		r.owners[row].inc()
+	}
+}
+
+// Rebuilt records a rebuild that began at start and points the rows of the
+// new table at their owners counters, new members start from zero and the
+// counts of members that are gone are dropped
+func (r *Recorder) Rebuilt(start time.Time, members []netip.Addr, table []netip.Addr) {
+	if r.counters != nil {
+		r.mapRows(members, table)
+	}
+
+	r.lastRebuild = time.Since(start)
+	r.rebuildTime = r.rebuildTime + r.lastRebuild
+	r.rebuilds++
+}
+
+// Snapshot returns the lookup counts and rebuild times along with the size
+// and rows per member of the table, lookups are nil when off
+func (r *Recorder) Snapshot(size uint32, rows map[netip.Addr]uint32) Snapshot {
+	snapshot := Snapshot{
+		Size:               size,
+		Rows:               rows,
+		Rebuilds:           r.rebuilds,
+		RebuildSeconds:     r.rebuildTime.Seconds(),
+		LastRebuildSeconds: r.lastRebuild.Seconds(),
+	}
+
+	if r.counters != nil {
+		snapshot.Lookups = make(map[netip.Addr]uint64, len(r.counters))
+		for addr, c := range r.counters {
+			snapshot.Lookups[addr] = c.load()
+		}
+	}
+
+	return snapshot
+}
+
+func (r *Recorder) mapRows(members []netip.Addr, table []netip.Addr) {
+	counters := make(map[netip.Addr]*counter, len(members))
+	for _, addr := range members {
+		c, exists := r.counters[addr]
+		if !exists {
+			c = &counter{}
+		}
+		counters[addr] = c
+	}
+
+	if r.unowned == nil {
+		r.unowned = &counter{}
+	}
+
+	owners := make([]*counter, len(table))
+	for i, addr := range table {
+		c, exists := counters[addr]
+		if !exists {
+			c = r.unowned
+		}
+		owners[i] = c
+	}
+
+	r.counters = counters
+	r.owners = owners
+}
+
+type Snapshot struct {
+	Size     uint32
+	Rows     map[netip.Addr]uint32
+	Lookups  map[netip.Addr]uint64
+	Rebuilds uint64
+	// total and most recent time spent generating the table
+	RebuildSeconds     float64
+	LastRebuildSeconds float64
+}
+
+// WritePrometheus renders a snapshot in the prometheus text exposition
+// format, every metric name is prefixed with the namespace
+func WritePrometheus(w io.Writer, namespace string, s Snapshot) error {
+	bw := bufio.NewWriter(w)
+
+	members := make([]netip.Addr, 0, len(s.Rows))
+	for addr := range s.Rows {
+		members = append(members, addr)
+	}
+	for addr := range s.Lookups {
+		if _, exists := s.Rows[addr]; !exists {
+			members = append(members, addr)
+		}
+	}
+	slices.SortFunc(members, func(a netip.Addr, b netip.Addr) int {
+		return a.Compare(b)
+	})
+
+	if s.Lookups != nil {
+		header(bw, namespace, "lookups_total", "counter", "Lookups per member.")
+		for _, addr := range members {
+			fmt.Fprintf(bw, "%v_lookups_total{member=%q} %v\n", namespace, addr.String(), s.Lookups[addr])
+		}
+	}
+
+	header(bw, namespace, "rows", "gauge", "Table rows owned per member.")
+	for _, addr := range members {
+		fmt.Fprintf(bw, "%v_rows{member=%q} %v\n", namespace, addr.String(), s.Rows[addr])
+	}
+
+	header(bw, namespace, "members", "gauge", "Number of table members.")
+	fmt.Fprintf(bw, "%v_members %v\n", namespace, len(s.Rows))
+
+	header(bw, namespace, "table_size", "gauge", "Number of table rows.")
+	fmt.Fprintf(bw, "%v_table_size %v\n", namespace, s.Size)
+
+	header(bw, namespace, "rebuilds_total", "counter", "Number of table rebuilds.")
+	fmt.Fprintf(bw, "%v_rebuilds_total %v\n", namespace, s.Rebuilds)
+
+	header(bw, namespace, "rebuild_seconds_total", "counter", "Total time spent rebuilding the table.")
+	fmt.Fprintf(bw, "%v_rebuild_seconds_total %v\n", namespace, s.RebuildSeconds)
+
+	header(bw, namespace, "last_rebuild_seconds", "gauge", "Time spent on the most recent table rebuild.")
+	fmt.Fprintf(bw, "%v_last_rebuild_seconds %v\n", namespace, s.LastRebuildSeconds)
+
+	return bw.Flush()
+}
+
+func header(w io.Writer, namespace string, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %v_%v %v\n", namespace, name, help)
+	fmt.Fprintf(w, "# TYPE %v_%v %v\n", namespace, name, kind)
+}
@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"bytes"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	a := netip.MustParseAddr("192.0.2.1")
+	b := netip.MustParseAddr("192.0.2.2")
+	c := netip.MustParseAddr("192.0.2.3")
+
+	r := Recorder{}
+	table := []netip.Addr{a, b, c, a}
+
+	// off by default
+	r.Inc(0)
+	assert.Nil(t, r.Snapshot(4, nil).Lookups)
+
+	r.SetLookups(true, []netip.Addr{a, b, c}, table)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := uint64(0); i < 1000; i++ {
+				r.Inc(i % 4)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, map[netip.Addr]uint64{a: 8 * 500, b: 8 * 250, c: 8 * 250}, r.Snapshot(4, nil).Lookups)
+
+	// lookups of a single row are spread over the shards
+	for i := range r.counters[b] {
+		assert.Greater(t, r.counters[b][i].Load(), uint64(0))
+	}
+
+	// members that stay keep counting on the same counter, new ones start
+	// from zero and gone ones are dropped
+	d := netip.MustParseAddr("192.0.2.4")
+	r.Rebuilt(time.Now(), []netip.Addr{a, c, d}, []netip.Addr{a, d, c, a})
+	r.Inc(0)
+	r.Inc(1)
+
+	snapshot := r.Snapshot(4, nil)
+	assert.Equal(t, map[netip.Addr]uint64{a: 8*500 + 1, c: 8 * 250, d: 1}, snapshot.Lookups)
+	assert.Equal(t, uint64(1), snapshot.Rebuilds)
+
+	// rows without an owner are counted but never reported
+	r.Rebuilt(time.Now(), []netip.Addr{a}, []netip.Addr{a, {}, {}, a})
+	r.Inc(1)
+	assert.Equal(t, map[netip.Addr]uint64{a: 8*500 + 1}, r.Snapshot(4, nil).Lookups)
+
+	// clones count on their own
+	clone := r.Clone()
+	assert.True(t, clone.Enabled())
+	clone.Inc(0)
+	clone.Inc(1)
+	assert.Equal(t, map[netip.Addr]uint64{a: 8*500 + 2}, clone.Snapshot(4, nil).Lookups)
+	assert.Equal(t, map[netip.Addr]uint64{a: 8*500 + 1}, r.Snapshot(4, nil).Lookups)
+
+	r.SetLookups(false, nil, nil)
+	assert.False(t, r.Enabled())
+	r.Inc(0)
+	assert.Nil(t, r.Snapshot(4, nil).Lookups)
+	assert.Equal(t, uint64(2), r.Snapshot(4, nil).Rebuilds)
+}
+
+func TestWritePrometheus(t *testing.T) {
+	s := Snapshot{
+		Size: 200,
+		Rows: map[netip.Addr]uint32{
+			netip.MustParseAddr("192.0.2.2"): 120,
+			netip.MustParseAddr("192.0.2.1"): 80,
+		},
+		Lookups: map[netip.Addr]uint64{
+			netip.MustParseAddr("192.0.2.1"): 7,
+			netip.MustParseAddr("192.0.2.2"): 12,
+		},
+		Rebuilds:           2,
+		RebuildSeconds:     0.5,
+		LastRebuildSeconds: 0.25,
+	}
+
+	var buf bytes.Buffer
+	err := WritePrometheus(&buf, "rama", s)
+	assert.Nil(t, err)
+
+	want := `# HELP rama_lookups_total Lookups per member.
+# TYPE rama_lookups_total counter
+rama_lookups_total{member="192.0.2.1"} 7
+rama_lookups_total{member="192.0.2.2"} 12
+# HELP rama_rows Table rows owned per member.
+# TYPE rama_rows gauge
+rama_rows{member="192.0.2.1"} 80
+rama_rows{member="192.0.2.2"} 120
+# HELP rama_members Number of table members.
+# TYPE rama_members gauge
+rama_members 2
+# HELP rama_table_size Number of table rows.
+# TYPE rama_table_size gauge
+rama_table_size 200
+# HELP rama_rebuilds_total Number of table rebuilds.
+# TYPE rama_rebuilds_total counter
+rama_rebuilds_total 2
+# HELP rama_rebuild_seconds_total Total time spent rebuilding the table.
+# TYPE rama_rebuild_seconds_total counter
+rama_rebuild_seconds_total 0.5
+# HELP rama_last_rebuild_seconds Time spent on the most recent table rebuild.
+# TYPE rama_last_rebuild_seconds gauge
+rama_last_rebuild_seconds 0.25
+`
+	assert.Equal(t, want, buf.String())
+
+	// without lookups the counter is left out
+	s.Lookups = nil
+	buf.Reset()
+	err = WritePrometheus(&buf, "rama", s)
+	assert.Nil(t, err)
+	assert.NotContains(t, buf.String(), "lookups_total")
+}
+
+func BenchmarkInc(b *testing.B) {
+	members := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")}
+	r := Recorder{}
+	r.SetLookups(true, members, []netip.Addr{members[0], members[1], members[0], members[1]})
+
+	b.RunParallel(func(pb *testing.PB) {
+		row := uint64(0)
+		for pb.Next() {
+			r.Inc(row % 4)
+			row++
+		}
+	})
+}
+
+// every goroutine looks up the same row, the contention sharding is for
+func BenchmarkIncSameRow(b *testing.B) {
+	members := []netip.Addr{netip.MustParseAddr("192.0.2.1")}
+	r := Recorder{}
+	r.SetLookups(true, members, []netip.Addr{members[0]})
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			r.Inc(0)
+		}
+	})
+}
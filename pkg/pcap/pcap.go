@@ -0,0 +1,611 @@
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"time"
+)
+
+// the file layouts follow the libpcap file format and the pcapng draft
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcap-04.html
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+
+const (
+	LinkTypeNull     uint16 = 0
+	LinkTypeEthernet uint16 = 1
+	LinkTypeRaw      uint16 = 101
+	LinkTypeLinuxSLL uint16 = 113
+	LinkTypeIPv4     uint16 = 228
+	LinkTypeIPv6     uint16 = 229
+
+	ProtoTCP  uint8 = 6
+	ProtoUDP  uint8 = 17
+	ProtoSCTP uint8 = 132
+
+	// largest packet we will allocate a buffer for
+	MaxPacketSize = 256 * 1024
+
+	// largest pcapng block, room for a packet of MaxPacketSize plus the
+	// block and enhanced packet headers and some options
+	maxBlockSize = MaxPacketSize + 64
+
+	magicMicros     = 0xa1b2c3d4
+	magicNanos      = 0xa1b23c4d
+	magicSectionHdr = 0x0a0d0d0a
+	magicByteOrder  = 0x1a2b3c4d
+
+	blockInterface      = 1
+	blockSimplePacket   = 3
+	blockEnhancedPacket = 6
+
+	optionEnd     = 0
+	optionTSResol = 9
+
+	etherTypeIPv4   = 0x0800
+	etherTypeIPv6   = 0x86dd
+	etherTypeVLAN   = 0x8100
+	etherTypeQinQ   = 0x88a8
+	etherTypeQinQv1 = 0x9100
+)
+
+var (
+	ErrFormat    = errors.New("pcap: not a pcap or pcapng file")
+	ErrTruncated = errors.New("pcap: truncated packet")
+	ErrNotIP     = errors.New("pcap: not an ip packet")
+	ErrLinkType  = errors.New("pcap: unsupported link type")
+)
+
+type Packet struct {
+	Timestamp time.Time
+	// length of the packet on the wire, Data may be shorter if the
+	// capture used a snap length
+	Length   uint32
+	LinkType uint16
+	// only valid until the next call to Next
+	Data []byte
+}
+
+type Flow struct {
+	Src     netip.Addr
+	Dst     netip.Addr
+	Proto   uint8
+	SrcPort uint16
+	DstPort uint16
+}
+
+type iface struct {
+	linkType uint16
+	snapLen  uint32
+	// ticks per second
+	resolution uint64
+}
+
+type Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	ng    bool
+	// pcap has a single interface, pcapng has one per interface block in
+	// the current section
+	ifaces []iface
+	buf    []byte
+}
+
+// NewReader detects a pcap or pcapng file from the first block and reads
+// its header, packets are then returned by Next
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{r: bufio.NewReaderSize(r, 64*1024)}
+
+	magic, err := reader.r.Peek(4)
+	if err != nil {
+		return nil, ErrFormat
+	}
+
+	switch {
+	case binary.BigEndian.Uint32(magic) == magicSectionHdr:
+		reader.ng = true
+		// the section header is read by Next like any other block
+		return reader, nil
+	case binary.LittleEndian.Uint32(magic) == magicMicros || binary.LittleEndian.Uint32(magic) == magicNanos:
+		reader.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(magic) == magicMicros || binary.BigEndian.Uint32(magic) == magicNanos:
+		reader.order = binary.BigEndian
+	default:
+		return nil, ErrFormat
+	}
+
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(reader.r, header); err != nil {
+		return nil, ErrFormat
+	}
+
+	resolution := uint64(1e6)
+	if reader.order.Uint32(header[0:4]) == magicNanos {
+		resolution = 1e9
+	}
+
+	// the link type shares its field with the fcs length in the upper bits
+	reader.ifaces = []iface{{
+		linkType:   uint16(reader.order.Uint32(header[20:24])),
+		snapLen:    reader.order.Uint32(header[16:20]),
+		resolution: resolution,
+	}}
+
+	return reader, nil
+}
+
+// Next returns the next packet or io.EOF at the end of the file
+func (r *Reader) Next() (Packet, error) {
+	if r.ng {
+		return r.nextBlock()
+	}
+
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		return Packet{}, eof(err)
+	}
+
+	captured := r.order.Uint32(header[8:12])
+	if captured > MaxPacketSize {
+		return Packet{}, fmt.Errorf("pcap: packet too large %v", captured)
+	}
+
+	data, err := r.read(captured)
+	if err != nil {
+		return Packet{}, err
+	}
+
+	// the sub second field is in micro or nanoseconds depending on the magic
+	sub := uint64(r.order.Uint32(header[4:8]))
+	return Packet{
+		Timestamp: time.Unix(int64(r.order.Uint32(header[0:4])), int64(sub*1e9/r.ifaces[0].resolution)),
+		Length:    r.order.Uint32(header[12:16]),
+		LinkType:  r.ifaces[0].linkType,
+		Data:      data,
+	}, nil
+}
+
+func (r *Reader) nextBlock() (Packet, error) {
+	for {
+		header, err := r.r.Peek(8)
+		if err != nil {
+			if len(header) == 0 {
+				return Packet{}, io.EOF
+			}
+			return Packet{}, io.ErrUnexpectedEOF
+		}
+
+		// a section header can switch the byte order so it has to be
+		// checked before the block length is trusted
+		if binary.BigEndian.Uint32(header[0:4]) == magicSectionHdr {
+			if err := r.section(); err != nil {
+				return Packet{}, err
+			}
+			continue
+		}
+
+		if r.order == nil {
+			return Packet{}, ErrFormat
+		}
+
+		blockType := r.order.Uint32(header[0:4])
+		length := r.order.Uint32(header[4:8])
+		if length < 12 || length%4 != 0 || length > maxBlockSize {
+			return Packet{}, fmt.Errorf("pcap: invalid block length %v", length)
+		}
+
+		block, err := r.read(length)
+		if err != nil {
+			return Packet{}, err
+		}
+		// strip the type and both lengths
+		body := block[8 : length-4]
+
+		switch blockType {
+		case blockInterface:
+			if err := r.addInterface(body); err != nil {
+				return Packet{}, err
+			}
+		case blockEnhancedPacket:
+			return r.enhancedPacket(body)
+		case blockSimplePacket:
+			return r.simplePacket(body)
+		}
+		// everything else (name resolution, statistics, custom) is skipped
+	}
+}
+
+func (r *Reader) section() error {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		return eof(err)
+	}
+
+	switch {
+	case binary.LittleEndian.Uint32(header[8:12]) == magicByteOrder:
+		r.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(header[8:12]) == magicByteOrder:
+		r.order = binary.BigEndian
+	default:
+		return ErrFormat
+	}
+
+	length := r.order.Uint32(header[4:8])
+	if length < 28 || length%4 != 0 || length > maxBlockSize {
+		return fmt.Errorf("pcap: invalid section header length %v", length)
+	}
+
+	if _, err := r.read(length - 12); err != nil {
+		return err
+	}
+
+	// interface ids are scoped to the section
+	r.ifaces = r.ifaces[:0]
+	return nil
+}
+
+func (r *Reader) addInterface(body []byte) error {
+	if len(body) < 8 {
+		return ErrTruncated
+	}
+
+	i := iface{
+		linkType:   r.order.Uint16(body[0:2]),
+		snapLen:    r.order.Uint32(body[4:8]),
+		resolution: 1e6,
+	}
+
+	options := body[8:]
+	for len(options) >= 4 {
+		code := r.order.Uint16(options[0:2])
+		length := int(r.order.Uint16(options[2:4]))
+		padded := (length + 3) &^ 3
+		if code == optionEnd || 4+padded > len(options) {
+			break
+		}
+
+		if code == optionTSResol && length == 1 {
+			// the high bit picks a power of two, otherwise a power of ten
+			exp := options[4] & 0x7f
+			base := 10.0
+			if options[4]&0x80 != 0 {
+				base = 2
+			}
+			if resolution := math.Pow(base, float64(exp)); resolution <= 1e18 {
+				i.resolution = uint64(resolution)
+			}
+		}
+
+		options = options[4+padded:]
+	}
+
+	r.ifaces = append(r.ifaces, i)
+	return nil
+}
+
+func (r *Reader) enhancedPacket(body []byte) (Packet, error) {
+	if len(body) < 20 {
+		return Packet{}, ErrTruncated
+	}
+
+	id := r.order.Uint32(body[0:4])
+	if id >= uint32(len(r.ifaces)) {
+		return Packet{}, fmt.Errorf("pcap: unknown interface %v", id)
+	}
+	i := r.ifaces[id]
+
+	captured := r.order.Uint32(body[12:16])
+	if uint64(captured) > uint64(len(body)-20) {
+		return Packet{}, ErrTruncated
+	}
+
+	if captured > MaxPacketSize {
+		return Packet{}, fmt.Errorf("pcap: packet too large %v", captured)
+	}
+
+	ticks := uint64(r.order.Uint32(body[4:8]))<<32 | uint64(r.order.Uint32(body[8:12]))
+	return Packet{
+		Timestamp: timestamp(ticks, i.resolution),
+		Length:    r.order.Uint32(body[16:20]),
+		LinkType:  i.linkType,
+		Data:      body[20 : 20+captured],
+	}, nil
+}
+
+func (r *Reader) simplePacket(body []byte) (Packet, error) {
+	if len(body) < 4 || len(r.ifaces) == 0 {
+		return Packet{}, ErrTruncated
+	}
+	i := r.ifaces[0]
+
+	// the captured length is whatever is left after the snap length
+	length := r.order.Uint32(body[0:4])
+	captured := min(length, uint32(len(body)-4), MaxPacketSize)
+	if i.snapLen > 0 {
+		captured = min(captured, i.snapLen)
+	}
+
+	return Packet{
+		Length:   length,
+		LinkType: i.linkType,
+		Data:     body[4 : 4+captured],
+	}, nil
+}
+
+// read returns the next n bytes in a buffer reused across calls
+func (r *Reader) read(n uint32) ([]byte, error) {
+	if n > maxBlockSize {
+		return nil, fmt.Errorf("pcap: block too large %v", n)
+	}
+
+	if uint32(cap(r.buf)) < n {
+		r.buf = make([]byte, n)
+	}
+	r.buf = r.buf[:n]
+
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		return nil, eof(err)
+	}
+
+	return r.buf, nil
+}
+
+// Decode parses the link, network and transport headers of a packet, ports
+// are left as zero for protocols without them or when the capture cut them off
+func Decode(linkType uint16, data []byte) (Flow, error) {
+	var etherType uint16
+
+	switch linkType {
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return Flow{}, ErrTruncated
+		}
+		etherType = binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+	case LinkTypeLinuxSLL:
+		if len(data) < 16 {
+			return Flow{}, ErrTruncated
+		}
+		etherType = binary.BigEndian.Uint16(data[14:16])
+		data = data[16:]
+	case LinkTypeNull:
+		// the address family is in host order of the capturing machine
+		if len(data) < 4 {
+			return Flow{}, ErrTruncated
+		}
+		family := binary.LittleEndian.Uint32(data[0:4])
+		if family > 0xffff {
+			family = binary.BigEndian.Uint32(data[0:4])
+		}
+		switch family {
+		case 2:
+			etherType = etherTypeIPv4
+		case 10, 24, 28, 30:
+			etherType = etherTypeIPv6
+		default:
+			return Flow{}, ErrNotIP
+		}
+		data = data[4:]
+	case LinkTypeRaw, LinkTypeIPv4, LinkTypeIPv6:
+		if len(data) < 1 {
+			return Flow{}, ErrTruncated
+		}
+		switch data[0] >> 4 {
+		case 4:
+			etherType = etherTypeIPv4
+		case 6:
+			etherType = etherTypeIPv6
+		default:
+			return Flow{}, ErrNotIP
+		}
+	default:
+		return Flow{}, ErrLinkType
+	}
+
+	// strip any number of stacked vlan tags
+	for etherType == etherTypeVLAN || etherType == etherTypeQinQ || etherType == etherTypeQinQv1 {
+		if len(data) < 4 {
+			return Flow{}, ErrTruncated
+		}
+		etherType = binary.BigEndian.Uint16(data[2:4])
+		data = data[4:]
+	}
+
+	switch etherType {
+	case etherTypeIPv4:
+		return decodeIPv4(data)
+	case etherTypeIPv6:
+		return decodeIPv6(data)
+	default:
+		return Flow{}, ErrNotIP
+	}
+}
+
+func decodeIPv4(data []byte) (Flow, error) {
+	if len(data) < 20 || data[0]>>4 != 4 {
+		return Flow{}, ErrTruncated
+	}
+
+	headerLen := int(data[0]&0x0f) * 4
+	if headerLen < 20 {
+		return Flow{}, ErrTruncated
+	}
+
+	flow := Flow{
+		Src:   netip.AddrFrom4([4]byte(data[12:16])),
+		Dst:   netip.AddrFrom4([4]byte(data[16:20])),
+		Proto: data[9],
+	}
+
+	// only the first fragment has the transport header
+	if binary.BigEndian.Uint16(data[6:8])&0x1fff != 0 || headerLen > len(data) {
+		return flow, nil
+	}
+
+	ports(&flow, data[headerLen:])
+	return flow, nil
+}
+
+func decodeIPv6(data []byte) (Flow, error) {
+	if len(data) < 40 || data[0]>>4 != 6 {
+		return Flow{}, ErrTruncated
+	}
+
+	flow := Flow{
+		Src: netip.AddrFrom16([16]byte(data[8:24])),
+		Dst: netip.AddrFrom16([16]byte(data[24:40])),
+	}
+
+	next := data[6]
+	data = data[40:]
+
+	// walk the extension headers to find the transport protocol
+	for {
+		switch next {
+		case 0, 43, 60:
+			if len(data) < 8 {
+				flow.Proto = next
+				return flow, nil
+			}
+			length := (int(data[1]) + 1) * 8
+			if length > len(data) {
+				flow.Proto = next
+				return flow, nil
+			}
+			next = data[0]
+			data = data[length:]
+		case 44:
+			if len(data) < 8 {
+				flow.Proto = next
+				return flow, nil
+			}
+			flow.Proto = data[0]
+			// later fragments have no transport header
+			if binary.BigEndian.Uint16(data[2:4])&0xfff8 != 0 {
+				return flow, nil
+			}
+			next = data[0]
+			data = data[8:]
+		default:
+			flow.Proto = next
+			ports(&flow, data)
+			return flow, nil
+		}
+	}
+}
+
+func ports(flow *Flow, data []byte) {
+	switch flow.Proto {
+	case ProtoTCP, ProtoUDP, ProtoSCTP:
+		if len(data) >= 4 {
+			flow.SrcPort = binary.BigEndian.Uint16(data[0:2])
+			flow.DstPort = binary.BigEndian.Uint16(data[2:4])
+		}
+	}
+}
+
+// Bytes returns a fixed size key for the flow suitable for
+// heavykeeper.AddBytes, a new slice is returned on every call
+func (f Flow) Bytes() []byte {
+	data := make([]byte, 37)
+	src := f.Src.As16()
+	dst := f.Dst.As16()
+	copy(data[0:16], src[:])
+	copy(data[16:32], dst[:])
+	data[32] = f.Proto
+	binary.BigEndian.PutUint16(data[33:35], f.SrcPort)
+	binary.BigEndian.PutUint16(data[35:37], f.DstPort)
+	return data
+}
+
+// FlowFromBytes reverses Bytes
+func FlowFromBytes(data []byte) (Flow, error) {
+	if len(data) != 37 {
+		return Flow{}, fmt.Errorf("pcap: invalid flow key length %v", len(data))
+	}
+
+	return Flow{
+		Src:     netip.AddrFrom16([16]byte(data[0:16])).Unmap(),
+		Dst:     netip.AddrFrom16([16]byte(data[16:32])).Unmap(),
+		Proto:   data[32],
+		SrcPort: binary.BigEndian.Uint16(data[33:35]),
+		DstPort: binary.BigEndian.Uint16(data[35:37]),
+	}, nil
+}
+
+func (f Flow) String() string {
+	return fmt.Sprintf("%v %v -> %v", f.Proto, netip.AddrPortFrom(f.Src, f.SrcPort), netip.AddrPortFrom(f.Dst, f.DstPort))
+}
+
+func timestamp(ticks uint64, resolution uint64) time.Time {
+	if resolution == 0 {
+		resolution = 1e6
+	}
+
+	seconds := ticks / resolution
+	fraction := ticks % resolution
+	nanos := uint64(float64(fraction) * 1e9 / float64(resolution))
+
+	return time.Unix(int64(seconds), int64(nanos))
+}
+
+func eof(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
+
+type Writer struct {
+	w        io.Writer
+	linkType uint16
+	snapLen  uint32
+}
+
+// NewWriter writes a little endian pcap header with microsecond timestamps,
+// packets are then added with WritePacket
+func NewWriter(w io.Writer, linkType uint16, snapLen uint32) (*Writer, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], magicMicros)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], snapLen)
+	binary.LittleEndian.PutUint32(header[20:24], uint32(linkType))
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &Writer{w: w, linkType: linkType, snapLen: snapLen}, nil
+}
+
+// WritePacket writes Data cut to the snap length, a zero Length is taken to
+// be the length of Data
+func (w *Writer) WritePacket(packet Packet) error {
+	data := packet.Data
+	if w.snapLen > 0 && uint32(len(data)) > w.snapLen {
+		data = data[:w.snapLen]
+	}
+
+	length := packet.Length
+	if length == 0 {
+		length = uint32(len(packet.Data))
+	}
+
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(packet.Timestamp.Unix()))
+	binary.LittleEndian.PutUint32(header[4:8], uint32(packet.Timestamp.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[8:12], uint32(len(data)))
+	binary.LittleEndian.PutUint32(header[12:16], length)
+
+	if _, err := w.w.Write(header); err != nil {
+		return err
+	}
+
+	_, err := w.w.Write(data)
+	return err
+}
@@ -0,0 +1,343 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+func ipv4(src string, dst string, proto uint8, srcPort uint16, dstPort uint16, payload int) []byte {
+	packet := make([]byte, 20+8+payload)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = proto
+	s := netip.MustParseAddr(src).As4()
+	d := netip.MustParseAddr(dst).As4()
+	copy(packet[12:16], s[:])
+	copy(packet[16:20], d[:])
+	binary.BigEndian.PutUint16(packet[20:22], srcPort)
+	binary.BigEndian.PutUint16(packet[22:24], dstPort)
+	return packet
+}
+
+func ipv6(src string, dst string, next uint8, ext []byte, srcPort uint16, dstPort uint16) []byte {
+	packet := make([]byte, 40, 40+len(ext)+8)
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(ext)+8))
+	packet[6] = next
+	packet[7] = 64
+	s := netip.MustParseAddr(src).As16()
+	d := netip.MustParseAddr(dst).As16()
+	copy(packet[8:24], s[:])
+	copy(packet[24:40], d[:])
+	packet = append(packet, ext...)
+	transport := make([]byte, 8)
+	binary.BigEndian.PutUint16(transport[0:2], srcPort)
+	binary.BigEndian.PutUint16(transport[2:4], dstPort)
+	return append(packet, transport...)
+}
+
+func ethernet(etherType uint16, payload []byte, vlans ...uint16) []byte {
+	frame := make([]byte, 12)
+	for _, vlan := range vlans {
+		frame = binary.BigEndian.AppendUint16(frame, vlan)
+		frame = binary.BigEndian.AppendUint16(frame, 100)
+	}
+	frame = binary.BigEndian.AppendUint16(frame, etherType)
+	return append(frame, payload...)
+}
+
+func block(order byteOrder, blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	length := uint32(len(body) + 12)
+	data := order.AppendUint32(nil, blockType)
+	data = order.AppendUint32(data, length)
+	data = append(data, body...)
+	return order.AppendUint32(data, length)
+}
+
+func pcapng(order byteOrder, packets [][]byte) []byte {
+	section := order.AppendUint32(nil, magicByteOrder)
+	section = order.AppendUint16(section, 1)
+	section = order.AppendUint16(section, 0)
+	section = order.AppendUint64(section, 0xffffffffffffffff)
+	data := block(order, magicSectionHdr, section)
+
+	// nanosecond timestamps
+	iface := order.AppendUint16(nil, LinkTypeEthernet)
+	iface = order.AppendUint16(iface, 0)
+	iface = order.AppendUint32(iface, 0)
+	iface = order.AppendUint16(iface, optionTSResol)
+	iface = order.AppendUint16(iface, 1)
+	iface = append(iface, 9, 0, 0, 0)
+	iface = order.AppendUint32(iface, optionEnd)
+	data = append(data, block(order, blockInterface, iface)...)
+
+	// a name resolution block that should be skipped
+	data = append(data, block(order, 4, []byte{0, 0, 0, 0})...)
+
+	for i, packet := range packets {
+		ticks := uint64(1700000000)*1e9 + uint64(i)
+		body := order.AppendUint32(nil, 0)
+		body = order.AppendUint32(body, uint32(ticks>>32))
+		body = order.AppendUint32(body, uint32(ticks))
+		body = order.AppendUint32(body, uint32(len(packet)))
+		body = order.AppendUint32(body, uint32(len(packet)))
+		data = append(data, block(order, blockEnhancedPacket, append(body, packet...))...)
+	}
+
+	simple := order.AppendUint32(nil, uint32(len(packets[0])))
+	return append(data, block(order, blockSimplePacket, append(simple, packets[0]...))...)
+}
+
+func TestPcap(t *testing.T) {
+	packets := [][]byte{
+		ethernet(etherTypeIPv4, ipv4("192.0.2.1", "198.51.100.1", ProtoTCP, 1234, 443, 100)),
+		ethernet(etherTypeIPv6, ipv6("2001:db8::1", "2001:db8::2", ProtoUDP, nil, 5353, 53), etherTypeVLAN),
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, LinkTypeEthernet, 64)
+	assert.Nil(t, err)
+
+	now := time.Unix(1700000000, 123456000)
+	for _, packet := range packets {
+		assert.Nil(t, w.WritePacket(Packet{Timestamp: now, Data: packet}))
+	}
+
+	r, err := NewReader(&buf)
+	assert.Nil(t, err)
+
+	packet, err := r.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, now, packet.Timestamp)
+	assert.Equal(t, uint32(len(packets[0])), packet.Length)
+	// cut off by the snap length
+	assert.Equal(t, packets[0][:64], packet.Data)
+	assert.Equal(t, LinkTypeEthernet, packet.LinkType)
+
+	packet, err = r.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, packets[1][:64], packet.Data)
+
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+
+	// big endian with nanosecond timestamps
+	data := binary.BigEndian.AppendUint32(nil, magicNanos)
+	data = append(data, make([]byte, 12)...)
+	data = binary.BigEndian.AppendUint32(data, 65535)
+	data = binary.BigEndian.AppendUint32(data, uint32(LinkTypeRaw))
+	raw := ipv4("192.0.2.1", "198.51.100.1", ProtoUDP, 1, 2, 0)
+	data = binary.BigEndian.AppendUint32(data, 1700000000)
+	data = binary.BigEndian.AppendUint32(data, 5)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(raw)))
+	data = binary.BigEndian.AppendUint32(data, 1500)
+	data = append(data, raw...)
+
+	r, err = NewReader(bytes.NewReader(data))
+	assert.Nil(t, err)
+	packet, err = r.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, time.Unix(1700000000, 5), packet.Timestamp)
+	assert.Equal(t, uint32(1500), packet.Length)
+	assert.Equal(t, LinkTypeRaw, packet.LinkType)
+	assert.Equal(t, raw, packet.Data)
+
+	// cut off in the middle of a packet
+	r, err = NewReader(bytes.NewReader(data[:len(data)-4]))
+	assert.Nil(t, err)
+	_, err = r.Next()
+	assert.Equal(t, ErrTruncated, err)
+
+	_, err = NewReader(bytes.NewReader([]byte("not a pcap file")))
+	assert.Equal(t, ErrFormat, err)
+
+	_, err = NewReader(bytes.NewReader(nil))
+	assert.Equal(t, ErrFormat, err)
+}
+
+func TestPcapng(t *testing.T) {
+	packets := [][]byte{
+		ethernet(etherTypeIPv4, ipv4("192.0.2.1", "198.51.100.1", ProtoTCP, 1234, 443, 3)),
+		ethernet(etherTypeIPv6, ipv6("2001:db8::1", "2001:db8::2", ProtoUDP, nil, 5353, 53)),
+	}
+
+	for _, order := range []byteOrder{binary.LittleEndian, binary.BigEndian} {
+		data := pcapng(order, packets)
+		// a second section resets the interfaces
+		data = append(data, pcapng(order, packets)...)
+
+		r, err := NewReader(bytes.NewReader(data))
+		assert.Nil(t, err)
+
+		for section := 0; section < 2; section++ {
+			for i, expected := range packets {
+				packet, err := r.Next()
+				assert.Nil(t, err)
+				assert.Equal(t, expected, packet.Data)
+				assert.Equal(t, uint32(len(expected)), packet.Length)
+				assert.Equal(t, LinkTypeEthernet, packet.LinkType)
+				assert.Equal(t, time.Unix(1700000000, int64(i)), packet.Timestamp)
+			}
+
+			// simple packet block
+			packet, err := r.Next()
+			assert.Nil(t, err)
+			assert.Equal(t, packets[0], packet.Data)
+		}
+
+		_, err = r.Next()
+		assert.Equal(t, io.EOF, err)
+
+		r, err = NewReader(bytes.NewReader(data[:len(data)-2]))
+		assert.Nil(t, err)
+		for err == nil {
+			_, err = r.Next()
+		}
+		assert.NotEqual(t, io.EOF, err)
+
+		// the largest packet fits in a block along with its headers
+		largest := make([]byte, MaxPacketSize)
+		r, err = NewReader(bytes.NewReader(pcapng(order, [][]byte{largest})))
+		assert.Nil(t, err)
+		packet, err := r.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, largest, packet.Data)
+
+		r, err = NewReader(bytes.NewReader(pcapng(order, [][]byte{append(largest, make([]byte, 64)...)})))
+		assert.Nil(t, err)
+		_, err = r.Next()
+		assert.NotNil(t, err)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tcp := ipv4("192.0.2.1", "198.51.100.1", ProtoTCP, 1234, 443, 0)
+	udp6 := ipv6("2001:db8::1", "2001:db8::2", ProtoUDP, nil, 5353, 53)
+	v4Flow := Flow{
+		Src:     netip.MustParseAddr("192.0.2.1"),
+		Dst:     netip.MustParseAddr("198.51.100.1"),
+		Proto:   ProtoTCP,
+		SrcPort: 1234,
+		DstPort: 443,
+	}
+	v6Flow := Flow{
+		Src:     netip.MustParseAddr("2001:db8::1"),
+		Dst:     netip.MustParseAddr("2001:db8::2"),
+		Proto:   ProtoUDP,
+		SrcPort: 5353,
+		DstPort: 53,
+	}
+
+	// hop by hop options then a first fragment
+	hopByHop := []byte{44, 0, 0, 0, 0, 0, 0, 0}
+	fragment := []byte{ProtoUDP, 0, 0, 1, 0, 0, 0, 1}
+	extensions := ipv6("2001:db8::1", "2001:db8::2", 0, append(hopByHop, fragment...), 5353, 53)
+	later := ipv6("2001:db8::1", "2001:db8::2", 44, []byte{ProtoUDP, 0, 0, 8, 0, 0, 0, 1}, 5353, 53)
+
+	fragmented := ipv4("192.0.2.1", "198.51.100.1", ProtoTCP, 1234, 443, 0)
+	binary.BigEndian.PutUint16(fragmented[6:8], 10)
+
+	sll := append(make([]byte, 14), 0x08, 0x00)
+	null := binary.LittleEndian.AppendUint32(nil, 2)
+	nullV6 := binary.BigEndian.AppendUint32(nil, 30)
+
+	tests := []struct {
+		name     string
+		linkType uint16
+		data     []byte
+		flow     Flow
+		err      error
+	}{
+		{"ethernet", LinkTypeEthernet, ethernet(etherTypeIPv4, tcp), v4Flow, nil},
+		{"vlan", LinkTypeEthernet, ethernet(etherTypeIPv4, tcp, etherTypeVLAN), v4Flow, nil},
+		{"qinq", LinkTypeEthernet, ethernet(etherTypeIPv6, udp6, etherTypeQinQ, etherTypeVLAN), v6Flow, nil},
+		{"raw", LinkTypeRaw, tcp, v4Flow, nil},
+		{"raw ipv6", LinkTypeIPv6, udp6, v6Flow, nil},
+		{"sll", LinkTypeLinuxSLL, append(sll, tcp...), v4Flow, nil},
+		{"null", LinkTypeNull, append(null, tcp...), v4Flow, nil},
+		{"null ipv6", LinkTypeNull, append(nullV6, udp6...), v6Flow, nil},
+		{"extension headers", LinkTypeRaw, extensions, v6Flow, nil},
+		{"later fragment", LinkTypeRaw, later, Flow{Src: v6Flow.Src, Dst: v6Flow.Dst, Proto: ProtoUDP}, nil},
+		{"ipv4 fragment", LinkTypeRaw, fragmented, Flow{Src: v4Flow.Src, Dst: v4Flow.Dst, Proto: ProtoTCP}, nil},
+		{"no ports", LinkTypeRaw, tcp[:22], Flow{Src: v4Flow.Src, Dst: v4Flow.Dst, Proto: ProtoTCP}, nil},
+		{"arp", LinkTypeEthernet, ethernet(0x0806, make([]byte, 28)), Flow{}, ErrNotIP},
+		{"truncated ethernet", LinkTypeEthernet, make([]byte, 10), Flow{}, ErrTruncated},
+		{"truncated vlan", LinkTypeEthernet, ethernet(etherTypeVLAN, nil), Flow{}, ErrTruncated},
+		{"truncated ipv4", LinkTypeRaw, tcp[:19], Flow{}, ErrTruncated},
+		{"truncated ipv6", LinkTypeEthernet, ethernet(etherTypeIPv6, udp6[:39]), Flow{}, ErrTruncated},
+		{"unknown link type", 147, tcp, Flow{}, ErrLinkType},
+	}
+
+	for _, test := range tests {
+		flow, err := Decode(test.linkType, test.data)
+		assert.Equal(t, test.err, err, test.name)
+		assert.Equal(t, test.flow, flow, test.name)
+	}
+}
+
+func TestFlowBytes(t *testing.T) {
+	flows := []Flow{
+		{Src: netip.MustParseAddr("192.0.2.1"), Dst: netip.MustParseAddr("198.51.100.1"), Proto: ProtoTCP, SrcPort: 1234, DstPort: 443},
+		{Src: netip.MustParseAddr("2001:db8::1"), Dst: netip.MustParseAddr("2001:db8::2"), Proto: ProtoUDP, SrcPort: 5353, DstPort: 53},
+	}
+
+	for _, flow := range flows {
+		data := flow.Bytes()
+		assert.Equal(t, 37, len(data))
+
+		back, err := FlowFromBytes(data)
+		assert.Nil(t, err)
+		assert.Equal(t, flow, back)
+	}
+
+	assert.Equal(t, "6 192.0.2.1:1234 -> 198.51.100.1:443", flows[0].String())
+
+	_, err := FlowFromBytes([]byte{1, 2, 3})
+	assert.NotNil(t, err)
+}
+
+func FuzzReader(f *testing.F) {
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, LinkTypeEthernet, 0)
+	w.WritePacket(Packet{Data: ethernet(etherTypeIPv4, ipv4("192.0.2.1", "198.51.100.1", ProtoTCP, 1, 2, 0))})
+	f.Add(buf.Bytes())
+	f.Add(pcapng(binary.LittleEndian, [][]byte{ethernet(etherTypeIPv6, ipv6("2001:db8::1", "2001:db8::2", 0, []byte{ProtoUDP, 0, 0, 0, 0, 0, 0, 0}, 1, 2), etherTypeVLAN)}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, err := NewReader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		for i := 0; i < 1000; i++ {
+			packet, err := r.Next()
+			if err != nil {
+				return
+			}
+
+			if uint32(len(packet.Data)) > MaxPacketSize {
+				t.Fatalf("packet larger than max: %v", len(packet.Data))
+			}
+
+			flow, err := Decode(packet.LinkType, packet.Data)
+			if err == nil && (!flow.Src.IsValid() || !flow.Dst.IsValid()) {
+				t.Fatalf("invalid flow without error: %v", flow)
+			}
+		}
+	})
+}
@@ -1,17 +1,31 @@
 package rendezvous
 
 import (
+	"cmp"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math/rand/v2"
 	"net/netip"
+	"time"
 
 	"github.com/OneOfOne/xxhash"
+	"github.com/joewilliams/rama/internal/ipaddr"
+	"github.com/joewilliams/rama/pkg/metrics"
+	"golang.org/x/exp/slices"
 )
 
 const (
 	// number of table entries * 100 == table size
 	multiple = 100
+
+	// TableFormatVersion is bumped whenever the table generated for a given
+	// key, size and member list changes, every bump reshuffles existing flows
+	// on upgrade so it should only ever be done deliberately
+	TableFormatVersion = 1
+
+	// MaxPrefixMembers limits how many members prefixes can be expanded into
+	MaxPrefixMembers = 4096
 )
 
 type member struct {
@@ -24,6 +38,17 @@ type Table struct {
 	table   []netip.Addr
 	size    uint32
 	key     uint64
+	// lookups are masked to these prefix lengths before hashing
+	v4Bits int
+	v6Bits int
+	// unmap 4in6 addresses and strip zones from members and lookups
+	canonical bool
+	// previous generations newest first, each only holds the rows that
+	// differ from the generation after it
+	history    []map[uint32]netip.Addr
+	maxHistory int
+	// lookup counters and rebuild times
+	metrics metrics.Recorder
 }
 
 func New(key uint64, membersList []netip.Addr) (Table, error) {
@@ -48,6 +73,8 @@ func NewWithTableSize(key uint64, size uint32, membersList []netip.Addr) (Table,
 		members: members,
 		size:    size,
 		key:     key,
+		v4Bits:  32,
+		v6Bits:  128,
 	}
 
 	table.generateTable()
@@ -55,20 +82,187 @@ func NewWithTableSize(key uint64, size uint32, membersList []netip.Addr) (Table,
 	return table, nil
 }
 
+// NewFromPrefixes expands every address in the prefixes into a member,
+// addresses inside any of the exclude prefixes are
+// skipped, addresses in more than one prefix are only added once
+func NewFromPrefixes(key uint64, prefixes []netip.Prefix, exclude []netip.Prefix) (Table, error) {
+	membersList := []netip.Addr{}
+	seen := map[netip.Addr]bool{}
+
+	for _, prefix := range prefixes {
+		addrs, err := ipaddr.Expand(prefix, exclude, MaxPrefixMembers)
+		if err != nil {
+			return Table{}, err
+		}
+
+		for _, addr := range addrs {
+			if !seen[addr] {
+				seen[addr] = true
+				membersList = append(membersList, addr)
+			}
+		}
+
+		if len(membersList) > MaxPrefixMembers {
+			return Table{}, fmt.Errorf("too many members: %v", len(membersList))
+		}
+	}
+
+	return New(key, membersList)
+}
+
 func (t *Table) Key() uint64 {
 	return t.key
 }
 
+// Size returns the number of rows in the table
+func (t *Table) Size() uint32 {
+	return t.size
+}
+
 func (t *Table) Get(addr netip.Addr) netip.Addr {
-	return t.table[t.xxhash(addr.AsSlice())&uint64(t.size-1)]
+	row := t.row(addr)
+
+	t.metrics.Inc(row)
+
+	return t.table[row]
+}
+
+// GetHistory returns the owner of an address in the current generation
+// followed by its owner in each retained previous generation, newest first
+func (t *Table) GetHistory(addr netip.Addr) []netip.Addr {
+	row := uint32(t.row(addr))
+	owner := t.table[row]
+
+	owners := make([]netip.Addr, 0, len(t.history)+1)
+	owners = append(owners, owner)
+
+	for _, diff := range t.history {
+		if prev, changed := diff[row]; changed {
+			owner = prev
+		}
+		owners = append(owners, owner)
+	}
+
+	return owners
+}
+
+// SetHistory sets how many previous generations of the table are kept
+// around for GetHistory
+func (t *Table) SetHistory(generations int) {
+	t.maxHistory = max(0, generations)
+	if len(t.history) > t.maxHistory {
+		t.history = t.history[:t.maxHistory]
+	}
+}
+
+// SetAffinity masks lookup addresses to the given prefix lengths before
+// hashing so every client inside a prefix maps to the same member, 32 and
+// 128 turn it off
+func (t *Table) SetAffinity(v4Bits int, v6Bits int) error {
+	if v4Bits < 0 || v4Bits > 32 || v6Bits < 0 || v6Bits > 128 {
+		return fmt.Errorf("invalid prefix lengths: %v, %v", v4Bits, v6Bits)
+	}
+
+	t.v4Bits = v4Bits
+	t.v6Bits = v6Bits
+
+	return nil
+}
+
+// SetMembers replaces every member with a single table rebuild
+func (t *Table) SetMembers(membersList []netip.Addr) error {
+	if len(membersList) < 1 {
+		return fmt.Errorf("too few members: %v", len(membersList))
+	}
+
+	// both forms of an address are one member when canonical
+	seen := make(map[netip.Addr]bool, len(membersList))
+	members := make([]member, 0, len(membersList))
+	for _, addr := range membersList {
+		if t.canonical {
+			addr = ipaddr.Canonical(addr)
+		}
+
+		if !seen[addr] {
+			seen[addr] = true
+			members = append(members, member{addr: addr, bytes: addr.AsSlice()})
+		}
+	}
+
+	t.members = members
+	t.generateTable()
+
+	return nil
+}
+
+// Clone returns a copy of the table that can be changed without affecting
+// the original, lookup counters start from the counts of the original but
+// are not shared with it
+func (t *Table) Clone() Table {
+	clone := *t
+	clone.members = slices.Clone(t.members)
+	clone.table = slices.Clone(t.table)
+	clone.history = slices.Clone(t.history)
+	clone.metrics = t.metrics.Clone()
+	return clone
+}
+
+// CopyOptions applies the affinity, canonical, history and metrics options
+// of another table, for instance one with a different key or size that is
+// being replaced. History and lookup counts start over
+func (t *Table) CopyOptions(from *Table) {
+	t.v4Bits = from.v4Bits
+	t.v6Bits = from.v6Bits
+	t.SetCanonical(from.canonical)
+	t.SetHistory(from.maxHistory)
+	t.SetMetrics(from.metrics.Enabled())
+}
+
+// SetCanonical unmaps IPv4-mapped IPv6 addresses and strips zones from
+// lookups and members so both forms of an address are treated the same,
+// existing members are rewritten and merged if they collide
+func (t *Table) SetCanonical(canonical bool) {
+	t.canonical = canonical
+	if !canonical {
+		return
+	}
+
+	changed := false
+	seen := make(map[netip.Addr]bool, len(t.members))
+	newMembers := make([]member, 0, len(t.members))
+
+	for _, m := range t.members {
+		addr := ipaddr.Canonical(m.addr)
+		if addr != m.addr {
+			changed = true
+		}
+
+		if !seen[addr] {
+			seen[addr] = true
+			newMembers = append(newMembers, member{addr: addr, bytes: addr.AsSlice()})
+		}
+	}
+
+	if changed {
+		t.members = newMembers
+		t.generateTable()
+	}
 }
 
 func (t *Table) Add(addr netip.Addr) {
+	if t.canonical {
+		addr = ipaddr.Canonical(addr)
+	}
+
 	t.members = append(t.members, member{addr: addr, bytes: addr.AsSlice()})
 	t.generateTable()
 }
 
 func (t *Table) Delete(addr netip.Addr) {
+	if t.canonical {
+		addr = ipaddr.Canonical(addr)
+	}
+
 	newMembers := make([]member, 0, len(t.members))
 	for _, member := range t.members {
 		if member.addr != addr {
@@ -79,34 +273,234 @@ func (t *Table) Delete(addr netip.Addr) {
 	t.generateTable()
 }
 
+func (t *Table) AddPrefix(prefix netip.Prefix, exclude []netip.Prefix) error {
+	addrs, err := ipaddr.Expand(prefix, exclude, MaxPrefixMembers)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[netip.Addr]bool, len(t.members))
+	for _, member := range t.members {
+		existing[member.addr] = true
+	}
+
+	newMembers := make([]member, 0, len(t.members)+len(addrs))
+	newMembers = append(newMembers, t.members...)
+	for _, addr := range addrs {
+		if t.canonical {
+			addr = ipaddr.Canonical(addr)
+		}
+
+		if !existing[addr] {
+			existing[addr] = true
+			newMembers = append(newMembers, member{addr: addr, bytes: addr.AsSlice()})
+		}
+	}
+
+	// addresses that are already members don't count twice
+	if len(newMembers) > MaxPrefixMembers {
+		return fmt.Errorf("too many members: %v", len(newMembers))
+	}
+
+	t.members = newMembers
+	t.generateTable()
+
+	return nil
+}
+
+// DeletePrefix removes every member inside the prefix, if no member would
+// be left the table is left untouched
+func (t *Table) DeletePrefix(prefix netip.Prefix) error {
+	if t.canonical {
+		prefix = ipaddr.CanonicalPrefix(prefix)
+	}
+
+	newMembers := make([]member, 0, len(t.members))
+	for _, member := range t.members {
+		if !prefix.Contains(member.addr) {
+			newMembers = append(newMembers, member)
+		}
+	}
+
+	if len(newMembers) < 1 {
+		return fmt.Errorf("too few members: %v", len(newMembers))
+	}
+
+	t.members = newMembers
+	t.generateTable()
+
+	return nil
+}
+
+// Subset returns a stable subset of members for a client, ranked by
+// rendezvous score for the client id. Adding or removing a member only
+// changes the subsets that member is, or would be, a part of
+func (t *Table) Subset(clientID string, size int) []netip.Addr {
+	type scored struct {
+		addr  netip.Addr
+		score uint64
+	}
+
+	scores := make([]scored, 0, len(t.members))
+	data := make([]byte, 0, 16+len(clientID))
+
+	for _, member := range t.members {
+		data = append(data, member.bytes...)
+		data = append(data, clientID...)
+		scores = append(scores, scored{addr: member.addr, score: t.xxhash(data)})
+		data = data[:0]
+	}
+
+	slices.SortFunc(scores, func(a scored, b scored) int {
+		return cmp.Compare(b.score, a.score)
+	})
+
+	size = max(0, min(size, len(scores)))
+	subset := make([]netip.Addr, 0, size)
+	for _, s := range scores[:size] {
+		subset = append(subset, s.addr)
+	}
+
+	return subset
+}
+
+// Stats returns the number of rows each member owns
+func (t *Table) Stats() map[netip.Addr]uint32 {
+	stats := make(map[netip.Addr]uint32, len(t.members))
+	for _, member := range t.members {
+		stats[member.addr] = 0
+	}
+
+	for _, addr := range t.table {
+		stats[addr]++
+	}
+
+	return stats
+}
+
+// SetMetrics turns per member lookup counters on or off, when off Get
+// does no extra work
+func (t *Table) SetMetrics(enabled bool) {
+	t.metrics.SetLookups(enabled, t.Members(), t.table)
+}
+
+// Metrics returns the lookup counters, row counts and rebuild times, the
+// lookups are nil when metrics are off
+func (t *Table) Metrics() metrics.Snapshot {
+	return t.metrics.Snapshot(t.size, t.Stats())
+}
+
+// WriteMetrics renders Metrics in the prometheus text exposition format
+func (t *Table) WriteMetrics(w io.Writer, namespace string) error {
+	return metrics.WritePrometheus(w, namespace, t.Metrics())
+}
+
+// Normalize returns the address Get hashes for a lookup, with the canonical
+// and affinity options applied
+func (t *Table) Normalize(addr netip.Addr) netip.Addr {
+	if t.canonical {
+		addr = ipaddr.Canonical(addr)
+	}
+
+	if t.v4Bits < 32 || t.v6Bits < 128 {
+		addr = ipaddr.Mask(addr, t.v4Bits, t.v6Bits)
+	}
+
+	return addr
+}
+
+// Members returns the current members in the order they were added
+func (t *Table) Members() []netip.Addr {
+	members := make([]netip.Addr, 0, len(t.members))
+	for _, member := range t.members {
+		members = append(members, member.addr)
+	}
+	return members
+}
+
+// Rows returns the primary and secondary (runner up) member for every row
+// in the table, the secondary is the same as the primary with one member
+func (t *Table) Rows() ([]netip.Addr, []netip.Addr) {
+	primary := make([]netip.Addr, t.size)
+	secondary := make([]netip.Addr, t.size)
+	bI := make([]byte, 4)
+	data := make([]byte, 0, 20)
+
+	for i := uint32(0); i < t.size; i++ {
+		primary[i], secondary[i] = t.rankRow(i, bI, data)
+	}
+
+	return primary, secondary
+}
+
 func (t *Table) generateTable() {
+	start := time.Now()
 	table := make([]netip.Addr, t.size)
 	bI := make([]byte, 4)
 	data := make([]byte, 0, 20) // 16+4 enough for v6 addr + bI
 
 	for i := uint32(0); i < t.size; i++ {
-		var highScore uint64
-		var highMember netip.Addr
+		table[i], _ = t.rankRow(i, bI, data)
+	}
 
-		binary.LittleEndian.PutUint32(bI, i)
+	if t.maxHistory > 0 && t.table != nil {
+		t.pushHistory(table)
+	}
 
-		for _, member := range t.members {
-			// hash the entry plus the table row index
-			data = append(data, member.bytes...)
-			data = append(data, bI...)
-			sum := t.xxhash(data)
-			data = data[:0] // clear it out before we use it again
+	t.table = table
+	t.metrics.Rebuilt(start, t.Members(), table)
+}
 
-			if sum > highScore {
-				highScore = sum
-				highMember = member.addr
-			}
+// pushHistory records the rows of the current table that the new table
+// changes, unchanged rows are shared with the newer generations
+func (t *Table) pushHistory(table []netip.Addr) {
+	diff := map[uint32]netip.Addr{}
+	for i := range table {
+		if table[i] != t.table[i] {
+			diff[uint32(i)] = t.table[i]
 		}
+	}
 
-		table[i] = highMember
+	if len(t.history) < t.maxHistory {
+		t.history = append(t.history, nil)
 	}
+	copy(t.history[1:], t.history)
+	t.history[0] = diff
+}
 
-	t.table = table
+// rankRow returns the highest and second highest scoring members for a row
+func (t *Table) rankRow(i uint32, bI []byte, data []byte) (netip.Addr, netip.Addr) {
+	var highScore, secondScore uint64
+	var highMember, secondMember netip.Addr
+
+	binary.LittleEndian.PutUint32(bI, i)
+
+	for _, member := range t.members {
+		// hash the entry plus the table row index
+		data = append(data, member.bytes...)
+		data = append(data, bI...)
+		sum := t.xxhash(data)
+		data = data[:0] // clear it out before we use it again
+
+		if sum > highScore {
+			secondScore, secondMember = highScore, highMember
+			highScore = sum
+			highMember = member.addr
+		} else if sum > secondScore {
+			secondScore = sum
+			secondMember = member.addr
+		}
+	}
+
+	if !secondMember.IsValid() {
+		secondMember = highMember
+	}
+
+	return highMember, secondMember
+}
+
+func (t *Table) row(addr netip.Addr) uint64 {
+	return t.xxhash(t.Normalize(addr).AsSlice()) & uint64(t.size-1)
 }
 
 func (t *Table) xxhash(data []byte) uint64 {
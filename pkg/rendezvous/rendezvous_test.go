@@ -1,13 +1,85 @@
 package rendezvous
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
 	"net/netip"
 	"testing"
 
+	"github.com/joewilliams/rama/internal/golden"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slices"
 )
 
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// the golden files hashed for each TableFormatVersion, pin a new sum when
+// bumping the version rather than changing an old one
+var goldenSums = map[int]string{
+	1: "9686381e34e619e0a85e710864710dbb89b819fefa8d858ea3e71125089d838f",
+}
+
+type goldenTable struct {
+	Version int               `json:"version"`
+	Key     uint64            `json:"key"`
+	Size    uint32            `json:"size"`
+	Members []netip.Addr      `json:"members"`
+	Lookups map[string]string `json:"lookups"`
+	Table   []netip.Addr      `json:"table"`
+}
+
+func TestGolden(t *testing.T) {
+	mixed := []netip.Addr{}
+	for i := 1; i <= 3; i++ {
+		mixed = append(mixed, netip.MustParseAddr(fmt.Sprintf("192.0.2.%v", i)))
+		mixed = append(mixed, netip.MustParseAddr(fmt.Sprintf("2001:db8::%v", i)))
+	}
+
+	many := []netip.Addr{}
+	for i := 1; i <= 20; i++ {
+		many = append(many, netip.MustParseAddr(fmt.Sprintf("10.0.%v.1", i)))
+	}
+
+	cases := map[string]goldenTable{
+		"golden_default.json": {Key: 1234567812345678, Members: mixed[:3]},
+		"golden_mixed.json":   {Key: 42, Size: 1024, Members: mixed},
+		"golden_single.json":  {Key: 9999, Size: 16, Members: mixed[:1]},
+		"golden_many.json":    {Key: 1, Size: 2048, Members: many},
+	}
+
+	files := map[string]any{}
+	for name, c := range cases {
+		var table Table
+		var err error
+
+		if c.Size == 0 {
+			table, err = New(c.Key, c.Members)
+		} else {
+			table, err = NewWithTableSize(c.Key, c.Size, c.Members)
+		}
+		assert.Nil(t, err)
+
+		got := goldenTable{
+			Version: TableFormatVersion,
+			Key:     c.Key,
+			Size:    table.size,
+			Members: c.Members,
+			Lookups: map[string]string{},
+			Table:   table.table,
+		}
+
+		for i := 0; i < 16; i++ {
+			lookup := fmt.Sprintf("198.51.100.%v", i)
+			got.Lookups[lookup] = table.Get(netip.MustParseAddr(lookup)).String()
+		}
+
+		files[name] = got
+	}
+
+	golden.Check(t, TableFormatVersion, goldenSums, *update, files)
+}
+
 func TestNew(t *testing.T) {
 	ips := []netip.Addr{
 		netip.MustParseAddr("192.0.2.111"),
@@ -193,6 +265,430 @@ func TestAdd(t *testing.T) {
 	assert.Equal(t, 76, count3)
 }
 
+func TestPrefixes(t *testing.T) {
+	prefixes := []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.0/28"),
+		netip.MustParsePrefix("2001:db8::/126"),
+	}
+
+	exclude := []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.0/32"),
+		netip.MustParsePrefix("192.0.2.15/32"),
+		netip.MustParsePrefix("2001:db8::/127"),
+	}
+
+	table, err := NewFromPrefixes(1234567812345678, prefixes, exclude)
+	assert.Nil(t, err)
+
+	members := table.Members()
+	assert.Equal(t, 16, len(members))
+	assert.NotContains(t, members, netip.MustParseAddr("192.0.2.0"))
+	assert.NotContains(t, members, netip.MustParseAddr("192.0.2.15"))
+	assert.NotContains(t, members, netip.MustParseAddr("2001:db8::1"))
+	assert.Contains(t, members, netip.MustParseAddr("2001:db8::3"))
+
+	want := map[string]netip.Addr{}
+	for i := 0; i < 22; i++ {
+		stringIP := fmt.Sprintf("198.51.100.%v", i)
+		want[stringIP] = table.Get(netip.MustParseAddr(stringIP))
+	}
+
+	// deleting the v6 prefix only moves its rows
+	err = table.DeletePrefix(netip.MustParsePrefix("2001:db8::/64"))
+	assert.Nil(t, err)
+	assert.Equal(t, 14, len(table.Members()))
+
+	for k, v := range want {
+		ip := table.Get(netip.MustParseAddr(k))
+		if v.Is6() {
+			assert.True(t, ip.Is4())
+		} else {
+			assert.Equal(t, v, ip)
+		}
+	}
+
+	// adding an overlapping prefix only adds the new addresses
+	err = table.AddPrefix(netip.MustParsePrefix("192.0.2.8/29"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 15, len(table.Members()))
+
+	// deleting every member is refused and the table is kept
+	before := table.Members()
+	err = table.DeletePrefix(netip.MustParsePrefix("192.0.2.0/24"))
+	assert.NotNil(t, err)
+	assert.Equal(t, before, table.Members())
+	assert.True(t, table.Get(netip.MustParseAddr("198.51.100.1")).IsValid())
+
+	// overlapping prefixes are only expanded once
+	overlap, err := NewFromPrefixes(1234, []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.0/28"),
+		netip.MustParsePrefix("192.0.2.0/30"),
+	}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 16, len(overlap.Members()))
+
+	// the limit counts members after overlaps with existing ones are removed
+	half := []netip.Addr{}
+	for addr := netip.MustParseAddr("10.0.0.0"); len(half) < MaxPrefixMembers/2; addr = addr.Next() {
+		half = append(half, addr)
+	}
+	full, err := NewWithTableSize(1234, 16, half)
+	assert.Nil(t, err)
+	assert.Equal(t, MaxPrefixMembers/2, len(full.Members()))
+	err = full.AddPrefix(netip.MustParsePrefix("10.0.0.0/20"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, MaxPrefixMembers, len(full.Members()))
+	err = full.AddPrefix(netip.MustParsePrefix("10.0.0.0/20"), nil)
+	assert.Nil(t, err)
+	err = full.AddPrefix(netip.MustParsePrefix("10.1.0.0/32"), nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, MaxPrefixMembers, len(full.Members()))
+
+	err = table.AddPrefix(netip.MustParsePrefix("10.0.0.0/8"), nil)
+	assert.NotNil(t, err)
+
+	_, err = NewFromPrefixes(1234, []netip.Prefix{netip.MustParsePrefix("2001:db8::/64")}, nil)
+	assert.NotNil(t, err)
+
+	_, err = NewFromPrefixes(1234, []netip.Prefix{{}}, nil)
+	assert.NotNil(t, err)
+
+	_, err = NewFromPrefixes(1234, []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")}, []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})
+	assert.NotNil(t, err)
+}
+
+func TestAffinity(t *testing.T) {
+	table, err := New(1234567812345678, []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("192.0.2.3"),
+		netip.MustParseAddr("192.0.2.4"),
+	})
+	assert.Nil(t, err)
+
+	err = table.SetAffinity(24, 56)
+	assert.Nil(t, err)
+
+	// every client in the /24 or /56 maps to the same member
+	v4 := table.Get(netip.MustParseAddr("198.51.100.0"))
+	v6 := table.Get(netip.MustParseAddr("2001:db8:0:100::"))
+	for i := 0; i <= 255; i++ {
+		assert.Equal(t, v4, table.Get(netip.MustParseAddr(fmt.Sprintf("198.51.100.%v", i))))
+		assert.Equal(t, v6, table.Get(netip.MustParseAddr(fmt.Sprintf("2001:db8:0:1%02x:%x::1", i, i))))
+	}
+
+	// mapped clients without canonicalization use the v4 prefix length on
+	// their low 32 bits rather than the v6 one
+	mapped := table.Get(netip.MustParseAddr("::ffff:198.51.100.0"))
+	seen := map[netip.Addr]bool{}
+	for i := 0; i <= 255; i++ {
+		assert.Equal(t, mapped, table.Get(netip.MustParseAddr(fmt.Sprintf("::ffff:198.51.100.%v", i))))
+		seen[table.Get(netip.MustParseAddr(fmt.Sprintf("::ffff:198.51.%v.1", i)))] = true
+	}
+	assert.Greater(t, len(seen), 1)
+
+	// and the lookup still doesn't allocate
+	lookup := netip.MustParseAddr("2001:db8::1")
+	assert.Equal(t, float64(0), testing.AllocsPerRun(100, func() { table.Get(lookup) }))
+
+	// turning it off goes back to hashing the whole address
+	err = table.SetAffinity(32, 128)
+	assert.Nil(t, err)
+
+	seen = map[netip.Addr]bool{}
+	for i := 0; i <= 255; i++ {
+		seen[table.Get(netip.MustParseAddr(fmt.Sprintf("198.51.100.%v", i)))] = true
+	}
+	assert.Greater(t, len(seen), 1)
+
+	err = table.SetAffinity(33, 56)
+	assert.NotNil(t, err)
+
+	err = table.SetAffinity(24, -1)
+	assert.NotNil(t, err)
+}
+
+func TestCanonical(t *testing.T) {
+	ips := []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("::ffff:192.0.2.1"),
+		netip.MustParseAddr("::ffff:192.0.2.2"),
+		netip.MustParseAddr("fe80::1%eth0"),
+	}
+
+	table, err := New(1234567812345678, ips)
+	assert.Nil(t, err)
+
+	table.SetCanonical(true)
+
+	// mapped and plain forms of a member are merged
+	assert.Equal(t, []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("fe80::1"),
+	}, table.Members())
+
+	for _, ip := range table.table {
+		assert.True(t, ip.Is4() || ip == netip.MustParseAddr("fe80::1"))
+	}
+
+	// and both forms of a lookup map to the same member
+	for i := 0; i <= 255; i++ {
+		v4 := netip.MustParseAddr(fmt.Sprintf("198.51.100.%v", i))
+		mapped := netip.MustParseAddr(fmt.Sprintf("::ffff:198.51.100.%v", i))
+		assert.Equal(t, table.Get(v4), table.Get(mapped))
+	}
+
+	assert.Equal(t, table.Get(netip.MustParseAddr("fe80::2")), table.Get(netip.MustParseAddr("fe80::2%eth1")))
+
+	table.Add(netip.MustParseAddr("::ffff:192.0.2.3"))
+	assert.Contains(t, table.Members(), netip.MustParseAddr("192.0.2.3"))
+
+	table.Delete(netip.MustParseAddr("::ffff:192.0.2.1"))
+	assert.NotContains(t, table.Members(), netip.MustParseAddr("192.0.2.1"))
+
+	// both forms of a member are merged when replacing every member
+	replaced := table.Clone()
+	err = replaced.SetMembers([]netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("::ffff:192.0.2.1")})
+	assert.Nil(t, err)
+	assert.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.1")}, replaced.Members())
+
+	// a mapped prefix matches the canonical members it covers
+	err = table.DeletePrefix(netip.MustParsePrefix("::ffff:192.0.2.2/128"))
+	assert.Nil(t, err)
+	assert.Equal(t, []netip.Addr{
+		netip.MustParseAddr("fe80::1"),
+		netip.MustParseAddr("192.0.2.3"),
+	}, table.Members())
+}
+
+func TestSubset(t *testing.T) {
+	ips := []netip.Addr{}
+	for i := 1; i <= 20; i++ {
+		ips = append(ips, netip.MustParseAddr(fmt.Sprintf("192.0.2.%v", i)))
+	}
+
+	table, err := New(1234567812345678, ips)
+	assert.Nil(t, err)
+
+	subsets := map[string][]netip.Addr{}
+	counts := map[netip.Addr]int{}
+
+	for i := 0; i < 1000; i++ {
+		client := fmt.Sprintf("proxy-%v", i)
+		subset := table.Subset(client, 5)
+		assert.Equal(t, 5, len(subset))
+		assert.Equal(t, subset, table.Subset(client, 5))
+
+		// smaller subsets are a prefix of larger ones
+		assert.Equal(t, subset[:3], table.Subset(client, 3))
+
+		subsets[client] = subset
+		for _, ip := range subset {
+			counts[ip]++
+		}
+	}
+
+	// each member should be in around 1000 * 5 / 20 subsets
+	for _, ip := range ips {
+		assert.InDelta(t, 250, counts[ip], 50)
+	}
+
+	// deleting a member only replaces it in the subsets it was in
+	toDelete := ips[0]
+	table.Delete(toDelete)
+
+	for client, before := range subsets {
+		after := table.Subset(client, 5)
+		assert.NotContains(t, after, toDelete)
+
+		if !slices.Contains(before, toDelete) {
+			assert.Equal(t, before, after)
+		} else {
+			for _, ip := range before {
+				if ip != toDelete {
+					assert.Contains(t, after, ip)
+				}
+			}
+		}
+	}
+
+	// adding a member only changes the subsets it joins
+	newMember := netip.MustParseAddr("2001:db8::1")
+	table.Add(newMember)
+
+	for client, before := range subsets {
+		if slices.Contains(before, toDelete) {
+			continue
+		}
+
+		after := table.Subset(client, 5)
+		if !slices.Contains(after, newMember) {
+			assert.Equal(t, before, after)
+		} else {
+			assert.Equal(t, 4, len(intersect(before, after)))
+		}
+	}
+
+	assert.Equal(t, 20, len(table.Subset("proxy-0", 100)))
+	assert.Equal(t, 0, len(table.Subset("proxy-0", -1)))
+}
+
+func intersect(a []netip.Addr, b []netip.Addr) []netip.Addr {
+	out := []netip.Addr{}
+	for _, ip := range a {
+		if slices.Contains(b, ip) {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+func TestHistory(t *testing.T) {
+	ips := []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("192.0.2.3"),
+	}
+
+	table, err := NewWithTableSize(1234567812345678, 256, ips)
+	assert.Nil(t, err)
+
+	table.SetHistory(2)
+
+	lookups := []netip.Addr{}
+	first := map[netip.Addr]netip.Addr{}
+	for i := 0; i <= 255; i++ {
+		lookup := netip.MustParseAddr(fmt.Sprintf("198.51.100.%v", i))
+		lookups = append(lookups, lookup)
+		first[lookup] = table.Get(lookup)
+		assert.Equal(t, []netip.Addr{first[lookup]}, table.GetHistory(lookup))
+	}
+
+	table.Delete(ips[0])
+
+	second := map[netip.Addr]netip.Addr{}
+	for _, lookup := range lookups {
+		second[lookup] = table.Get(lookup)
+		assert.Equal(t, []netip.Addr{second[lookup], first[lookup]}, table.GetHistory(lookup))
+	}
+
+	// only the changed rows are kept
+	assert.Equal(t, 1, len(table.history))
+	assert.Less(t, len(table.history[0]), 256/2)
+
+	newMember := netip.MustParseAddr("2001:db8::1")
+	table.Add(newMember)
+	table.Add(ips[0])
+
+	// only 2 previous generations are kept
+	for _, lookup := range lookups {
+		history := table.GetHistory(lookup)
+		assert.Equal(t, 3, len(history))
+		assert.Equal(t, table.Get(lookup), history[0])
+
+		// the generation with the new member but without ips[0]
+		if history[0] != ips[0] {
+			assert.Equal(t, history[0], history[1])
+		}
+
+		if history[1] != newMember {
+			assert.Equal(t, second[lookup], history[1])
+		}
+		assert.Equal(t, second[lookup], history[2])
+	}
+
+	table.SetHistory(0)
+	assert.Equal(t, 1, len(table.GetHistory(lookups[0])))
+}
+
+func TestMetrics(t *testing.T) {
+	ips := []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("192.0.2.3"),
+	}
+
+	table, err := NewWithTableSize(1234567812345678, 256, ips)
+	assert.Nil(t, err)
+
+	// off by default
+	table.Get(netip.MustParseAddr("198.51.100.1"))
+	assert.Nil(t, table.Metrics().Lookups)
+
+	table.SetMetrics(true)
+
+	want := map[netip.Addr]uint64{}
+	for i := 0; i <= 255; i++ {
+		want[table.Get(netip.MustParseAddr(fmt.Sprintf("198.51.100.%v", i)))]++
+	}
+
+	snapshot := table.Metrics()
+	assert.Equal(t, want, snapshot.Lookups)
+	assert.Equal(t, uint32(256), snapshot.Size)
+	assert.Equal(t, uint64(1), snapshot.Rebuilds)
+
+	// counts of members that stay are carried across rebuilds
+	table.Delete(ips[2])
+
+	snapshot = table.Metrics()
+	assert.Equal(t, uint64(2), snapshot.Rebuilds)
+	assert.Equal(t, want[ips[0]], snapshot.Lookups[ips[0]])
+	assert.Equal(t, want[ips[1]], snapshot.Lookups[ips[1]])
+	assert.NotContains(t, snapshot.Lookups, ips[2])
+
+	var buf bytes.Buffer
+	err = table.WriteMetrics(&buf, "rama")
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), fmt.Sprintf("rama_lookups_total{member=\"192.0.2.1\"} %v\n", want[ips[0]]))
+	assert.Contains(t, buf.String(), "rama_rebuilds_total 2\n")
+
+	// clones start from the same counts but count on their own
+	clone := table.Clone()
+	clone.Get(netip.MustParseAddr("198.51.100.1"))
+	assert.Equal(t, snapshot.Lookups, table.Metrics().Lookups)
+	assert.NotEqual(t, snapshot.Lookups, clone.Metrics().Lookups)
+
+	table.SetMetrics(false)
+	assert.Nil(t, table.Metrics().Lookups)
+}
+
+func TestRows(t *testing.T) {
+	ips := []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("192.0.2.3"),
+	}
+
+	table, err := New(1234567812345678, ips)
+	assert.Nil(t, err)
+
+	assert.Equal(t, ips, table.Members())
+
+	primary, secondary := table.Rows()
+	assert.Equal(t, table.table, primary)
+	assert.Equal(t, table.Size(), uint32(len(primary)))
+	assert.Equal(t, len(primary), len(secondary))
+
+	// the secondary is where a row goes when the primary is deleted
+	table.Delete(ips[0])
+
+	for i := range primary {
+		assert.NotEqual(t, primary[i], secondary[i])
+
+		if primary[i] == ips[0] {
+			assert.Equal(t, secondary[i], table.table[i])
+		}
+	}
+
+	// with one member both are the same
+	one, err := New(1234567812345678, ips[:1])
+	assert.Nil(t, err)
+
+	primary, secondary = one.Rows()
+	assert.Equal(t, primary, secondary)
+}
+
 func TestGetKeys(t *testing.T) {
 	ips := []netip.Addr{
 		netip.MustParseAddr("192.0.2.1"),
@@ -212,6 +708,81 @@ func TestBadNew(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func FuzzTable(f *testing.F) {
+	f.Add(uint64(1234), []byte{0, 192, 0, 2, 1, 0, 192, 0, 2, 2, 1, 192, 0, 2, 1})
+	f.Add(uint64(0), []byte{2, 32, 1, 13, 184, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 10, 0, 0, 1, 1, 10, 0, 0, 1})
+
+	// ops are an op byte followed by an address, 0 adds a v4 member,
+	// 1 deletes a v4 member, 2 adds a v6 member and 3 deletes a v6 member
+	f.Fuzz(func(t *testing.T, key uint64, ops []byte) {
+		table, err := NewWithTableSize(key, 64, []netip.Addr{netip.MustParseAddr("192.0.2.1")})
+		assert.Nil(t, err)
+
+		members := map[netip.Addr]bool{netip.MustParseAddr("192.0.2.1"): true}
+		lookup := netip.AddrFrom4([4]byte{198, 51, 100, byte(key)})
+
+		for len(ops) > 0 {
+			op := ops[0] % 4
+			ops = ops[1:]
+
+			var addr netip.Addr
+			if op < 2 {
+				if len(ops) < 4 {
+					return
+				}
+				addr = netip.AddrFrom4([4]byte(ops[:4]))
+				ops = ops[4:]
+			} else {
+				if len(ops) < 16 {
+					return
+				}
+				addr = netip.AddrFrom16([16]byte(ops[:16]))
+				ops = ops[16:]
+			}
+
+			before := make([]netip.Addr, len(table.table))
+			copy(before, table.table)
+
+			if op%2 == 0 {
+				if members[addr] {
+					continue
+				}
+
+				table.Add(addr)
+				members[addr] = true
+
+				// rows only ever move to the new member
+				for i := range before {
+					if table.table[i] != before[i] {
+						assert.Equal(t, addr, table.table[i])
+					}
+				}
+			} else {
+				if !members[addr] || len(members) == 1 {
+					continue
+				}
+
+				table.Delete(addr)
+				delete(members, addr)
+
+				// only rows of the deleted member move
+				for i := range before {
+					if before[i] != addr {
+						assert.Equal(t, before[i], table.table[i])
+					}
+				}
+			}
+
+			for _, ip := range table.table {
+				assert.True(t, ip.IsValid())
+				assert.True(t, members[ip])
+			}
+
+			assert.True(t, members[table.Get(lookup)])
+		}
+	})
+}
+
 func BenchmarkGenerateOneEntry(b *testing.B) {
 	ips := []netip.Addr{netip.MustParseAddr("192.0.2.1")}
 
@@ -262,3 +833,37 @@ func BenchmarkGenerateLookup(b *testing.B) {
 		table.Get(lookupIP)
 	}
 }
+
+func BenchmarkGenerateLookupAffinity(b *testing.B) {
+	table, _ := New(1234, []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("192.0.2.3"),
+	})
+
+	table.SetAffinity(24, 56)
+
+	lookupIP := netip.MustParseAddr("2001:db8::1")
+
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		table.Get(lookupIP)
+	}
+}
+
+func BenchmarkGenerateLookupMetrics(b *testing.B) {
+	table, _ := New(1234, []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("192.0.2.3"),
+	})
+
+	table.SetMetrics(true)
+
+	lookupIP := netip.MustParseAddr("192.0.2.4")
+
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		table.Get(lookupIP)
+	}
+}
@@ -0,0 +1,165 @@
+package splitter
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+
+	"github.com/OneOfOne/xxhash"
+	"github.com/joewilliams/rama/pkg/rendezvous"
+)
+
+const (
+	// Default is the cohort for every key not in another cohort
+	Default = "default"
+
+	// the hash space is split into this many slots, 0.0001% each
+	slots = 1000000
+)
+
+// every cohort reserves a fixed range of slots for its max percentage in
+// the order cohorts are added, only the start of that range up to the
+// current percentage belongs to the cohort and the rest is part of the
+// default cohort. raising a percentage therefore only ever takes slots
+// from the default cohort and lowering it only gives them back
+
+type cohort struct {
+	name    string
+	start   uint64
+	max     uint64
+	percent uint64
+	table   *rendezvous.Table
+}
+
+type Splitter struct {
+	key      uint64
+	cohorts  []cohort
+	reserved uint64
+	table    *rendezvous.Table
+}
+
+// New creates a splitter where every key starts in the default cohort, the
+// key should be different from the keys used by the tables. Addresses are
+// normalized with the canonical and affinity options of the default table
+// before picking a cohort
+func New(key uint64, defaultTable *rendezvous.Table) Splitter {
+	return Splitter{key: key, table: defaultTable}
+}
+
+func (s *Splitter) Key() uint64 {
+	return s.key
+}
+
+// AddCohort reserves up to max percent of keys for a cohort, it starts with
+// none of them
+func (s *Splitter) AddCohort(name string, max float64, table *rendezvous.Table) error {
+	if name == Default || s.find(name) >= 0 {
+		return fmt.Errorf("cohort already exists: %v", name)
+	}
+
+	maxSlots, err := toSlots(max)
+	if err != nil {
+		return err
+	}
+
+	if s.reserved+maxSlots > slots {
+		return fmt.Errorf("too much reserved: %v", float64(s.reserved+maxSlots)/slots*100)
+	}
+
+	s.cohorts = append(s.cohorts, cohort{
+		name:  name,
+		start: s.reserved,
+		max:   maxSlots,
+		table: table,
+	})
+	s.reserved = s.reserved + maxSlots
+
+	return nil
+}
+
+// SetPercent sets the percentage of keys in a cohort, up to its max
+func (s *Splitter) SetPercent(name string, percent float64) error {
+	c := s.find(name)
+	if c < 0 {
+		return fmt.Errorf("unknown cohort: %v", name)
+	}
+
+	percentSlots, err := toSlots(percent)
+	if err != nil {
+		return err
+	}
+
+	if percentSlots > s.cohorts[c].max {
+		return fmt.Errorf("percent over max for %v: %v", name, percent)
+	}
+
+	s.cohorts[c].percent = percentSlots
+
+	return nil
+}
+
+// Percents returns the current percentage of keys in each cohort
+func (s *Splitter) Percents() map[string]float64 {
+	percents := map[string]float64{}
+	remaining := uint64(slots)
+
+	for _, c := range s.cohorts {
+		percents[c.name] = float64(c.percent) / slots * 100
+		remaining = remaining - c.percent
+	}
+	percents[Default] = float64(remaining) / slots * 100
+
+	return percents
+}
+
+// Cohort returns the name of the cohort an address is in
+func (s *Splitter) Cohort(addr netip.Addr) string {
+	c := s.cohort(addr)
+	if c < 0 {
+		return Default
+	}
+	return s.cohorts[c].name
+}
+
+// Get returns the member of the table for the cohort the address is in
+func (s *Splitter) Get(addr netip.Addr) netip.Addr {
+	c := s.cohort(addr)
+	if c < 0 {
+		return s.table.Get(addr)
+	}
+	return s.cohorts[c].table.Get(addr)
+}
+
+func (s *Splitter) cohort(addr netip.Addr) int {
+	// hash what the default table would so clients it treats as one, by
+	// canonical form or affinity prefix, always share a cohort
+	addr = s.table.Normalize(addr)
+
+	// use the high bits, tables index rows with the low bits
+	sum := xxhash.Checksum64S(addr.AsSlice(), s.key)
+	slot := (sum >> 32) * slots >> 32
+
+	for c := range s.cohorts {
+		if slot >= s.cohorts[c].start && slot < s.cohorts[c].start+s.cohorts[c].percent {
+			return c
+		}
+	}
+
+	return -1
+}
+
+func (s *Splitter) find(name string) int {
+	for c := range s.cohorts {
+		if s.cohorts[c].name == name {
+			return c
+		}
+	}
+	return -1
+}
+
+func toSlots(percent float64) (uint64, error) {
+	if percent < 0 || percent > 100 || math.IsNaN(percent) {
+		return 0, fmt.Errorf("invalid percent: %v", percent)
+	}
+	return uint64(math.Round(percent / 100 * slots)), nil
+}
@@ -0,0 +1,149 @@
+package splitter
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/joewilliams/rama/pkg/rendezvous"
+	"github.com/stretchr/testify/assert"
+)
+
+func testTable(t testing.TB, prefix string) *rendezvous.Table {
+	ips := []netip.Addr{}
+	for i := 1; i <= 3; i++ {
+		ips = append(ips, netip.MustParseAddr(fmt.Sprintf("%v.%v", prefix, i)))
+	}
+
+	table, err := rendezvous.New(1234567812345678, ips)
+	assert.Nil(t, err)
+
+	return &table
+}
+
+func lookups() []netip.Addr {
+	addrs := []netip.Addr{}
+	for i := 0; i <= 255; i++ {
+		for j := 0; j <= 255; j++ {
+			addrs = append(addrs, netip.AddrFrom4([4]byte{10, 0, byte(i), byte(j)}))
+		}
+	}
+	return addrs
+}
+
+func TestSplit(t *testing.T) {
+	prod := testTable(t, "192.0.2")
+	canary := testTable(t, "198.51.100")
+	beta := testTable(t, "203.0.113")
+
+	s := New(42, prod)
+	assert.Nil(t, s.AddCohort("canary", 10, canary))
+	assert.Nil(t, s.AddCohort("beta", 50, beta))
+
+	// everything starts in the default cohort
+	for _, addr := range lookups()[:1000] {
+		assert.Equal(t, Default, s.Cohort(addr))
+		assert.Equal(t, prod.Get(addr), s.Get(addr))
+	}
+
+	assert.Nil(t, s.SetPercent("canary", 2))
+	assert.Nil(t, s.SetPercent("beta", 20))
+
+	before := map[netip.Addr]string{}
+	counts := map[string]float64{}
+
+	for _, addr := range lookups() {
+		cohort := s.Cohort(addr)
+		before[addr] = cohort
+		counts[cohort]++
+
+		switch cohort {
+		case "canary":
+			assert.Equal(t, canary.Get(addr), s.Get(addr))
+		case "beta":
+			assert.Equal(t, beta.Get(addr), s.Get(addr))
+		default:
+			assert.Equal(t, prod.Get(addr), s.Get(addr))
+		}
+	}
+
+	total := float64(len(before))
+	assert.InDelta(t, 0.02, counts["canary"]/total, 0.005)
+	assert.InDelta(t, 0.20, counts["beta"]/total, 0.01)
+	assert.InDelta(t, 0.78, counts[Default]/total, 0.01)
+
+	// raising the canary only takes keys from the default cohort
+	assert.Nil(t, s.SetPercent("canary", 5))
+
+	moved := 0.0
+	for addr, cohort := range before {
+		after := s.Cohort(addr)
+		if after != cohort {
+			assert.Equal(t, Default, cohort)
+			assert.Equal(t, "canary", after)
+			moved++
+		}
+	}
+	assert.InDelta(t, 0.03, moved/total, 0.005)
+
+	// and lowering it only gives them back
+	assert.Nil(t, s.SetPercent("canary", 2))
+
+	for addr, cohort := range before {
+		assert.Equal(t, cohort, s.Cohort(addr))
+	}
+
+	percents := s.Percents()
+	assert.InDelta(t, 2, percents["canary"], 0.0001)
+	assert.InDelta(t, 20, percents["beta"], 0.0001)
+	assert.InDelta(t, 78, percents[Default], 0.0001)
+}
+
+func TestNormalize(t *testing.T) {
+	prod := testTable(t, "192.0.2")
+	assert.Nil(t, prod.SetAffinity(24, 56))
+	prod.SetCanonical(true)
+
+	s := New(42, prod)
+	assert.Nil(t, s.AddCohort("canary", 50, testTable(t, "198.51.100")))
+	assert.Nil(t, s.SetPercent("canary", 50))
+
+	// every client in a /24, in either form, lands in the same cohort
+	seen := map[string]bool{}
+	for i := 0; i <= 255; i++ {
+		cohort := s.Cohort(netip.AddrFrom4([4]byte{10, 0, byte(i), 0}))
+		seen[cohort] = true
+
+		for j := 1; j <= 255; j = j + 16 {
+			assert.Equal(t, cohort, s.Cohort(netip.AddrFrom4([4]byte{10, 0, byte(i), byte(j)})))
+			assert.Equal(t, cohort, s.Cohort(netip.MustParseAddr(fmt.Sprintf("::ffff:10.0.%v.%v", i, j))))
+		}
+	}
+	assert.Equal(t, 2, len(seen))
+}
+
+func TestBadCohorts(t *testing.T) {
+	s := New(42, testTable(t, "192.0.2"))
+
+	assert.NotNil(t, s.AddCohort(Default, 10, testTable(t, "198.51.100")))
+	assert.NotNil(t, s.AddCohort("canary", 101, testTable(t, "198.51.100")))
+	assert.Nil(t, s.AddCohort("canary", 60, testTable(t, "198.51.100")))
+	assert.NotNil(t, s.AddCohort("canary", 10, testTable(t, "198.51.100")))
+	assert.NotNil(t, s.AddCohort("beta", 50, testTable(t, "203.0.113")))
+
+	assert.NotNil(t, s.SetPercent("canary", 61))
+	assert.NotNil(t, s.SetPercent("canary", -1))
+	assert.NotNil(t, s.SetPercent("beta", 1))
+}
+
+func BenchmarkGet(b *testing.B) {
+	s := New(42, testTable(b, "192.0.2"))
+	s.AddCohort("canary", 10, testTable(b, "198.51.100"))
+	s.SetPercent("canary", 2)
+
+	lookupIP := netip.MustParseAddr("192.0.2.4")
+
+	for n := 0; n < b.N; n++ {
+		s.Get(lookupIP)
+	}
+}
@@ -1,18 +1,32 @@
 package weighted_rendezvous
 
 import (
+	"cmp"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
 	"math/rand/v2"
 	"net/netip"
+	"time"
 
 	"github.com/OneOfOne/xxhash"
+	"github.com/joewilliams/rama/internal/ipaddr"
+	"github.com/joewilliams/rama/pkg/metrics"
+	"golang.org/x/exp/slices"
 )
 
 const (
 	// number of table entries * 100 == table size
 	multiple = 100
+
+	// TableFormatVersion is bumped whenever the table generated for a given
+	// key, size and member list changes, every bump reshuffles existing flows
+	// on upgrade so it should only ever be done deliberately
+	TableFormatVersion = 1
+
+	// MaxPrefixMembers limits how many members prefixes can be expanded into
+	MaxPrefixMembers = 4096
 )
 
 type member struct {
@@ -26,6 +40,13 @@ type Table struct {
 	size    uint32
 	key     uint64
 	table   []netip.Addr
+	// lookups are masked to these prefix lengths before hashing
+	v4Bits int
+	v6Bits int
+	// unmap 4in6 addresses and strip zones from members and lookups
+	canonical bool
+	// lookup counters and rebuild times
+	metrics metrics.Recorder
 }
 
 func New(key uint64, membersMap map[netip.Addr]float64) (Table, error) {
@@ -43,91 +64,497 @@ func NewWithTableSize(key uint64, size uint32, membersMap map[netip.Addr]float64
 
 	members := make([]member, 0, len(membersMap))
 	for k, v := range membersMap {
+		if err := checkWeight(v); err != nil {
+			return Table{}, err
+		}
 		members = append(members, member{addr: k, weight: v, bytes: k.AsSlice()})
 	}
 
 	table := Table{
-		key:     key,
-		members: members,
-		size:    size,
+		key:    key,
+		size:   size,
+		v4Bits: 32,
+		v6Bits: 128,
 	}
 
-	table.generateTable()
+	if err := table.update(members); err != nil {
+		return Table{}, err
+	}
 
 	return table, nil
 }
 
+// NewFromPrefixes expands every address in the prefixes into a member with
+// the weight of its prefix, addresses inside any of the exclude prefixes are
+// skipped, addresses in more than one prefix are only added once and must
+// have the same weight in each
+func NewFromPrefixes(key uint64, prefixes map[netip.Prefix]float64, exclude []netip.Prefix) (Table, error) {
+	membersMap := map[netip.Addr]float64{}
+
+	for prefix, weight := range prefixes {
+		addrs, err := ipaddr.Expand(prefix, exclude, MaxPrefixMembers)
+		if err != nil {
+			return Table{}, err
+		}
+
+		for _, addr := range addrs {
+			// overlapping prefixes are only ambiguous if their weights differ
+			if existing, exists := membersMap[addr]; exists && existing != weight {
+				return Table{}, fmt.Errorf("address in prefixes with different weights: %v", addr)
+			}
+			membersMap[addr] = weight
+		}
+
+		if len(membersMap) > MaxPrefixMembers {
+			return Table{}, fmt.Errorf("too many members: %v", len(membersMap))
+		}
+	}
+
+	return New(key, membersMap)
+}
+
 func (t *Table) Key() uint64 {
 	return t.key
 }
 
+// Size returns the number of rows in the table
+func (t *Table) Size() uint32 {
+	return t.size
+}
+
 func (t *Table) Get(addr netip.Addr) netip.Addr {
-	return t.table[t.xxhash(addr.AsSlice())&uint64(t.size-1)]
+	row := t.row(addr)
+
+	t.metrics.Inc(row)
+
+	return t.table[row]
 }
 
-func (t *Table) Add(addr netip.Addr, weight float64) {
-	t.members = append(t.members, member{addr: addr, weight: weight, bytes: addr.AsSlice()})
-	t.generateTable()
+// SetAffinity masks lookup addresses to the given prefix lengths before
+// hashing so every client inside a prefix maps to the same member, 32 and
+// 128 turn it off
+func (t *Table) SetAffinity(v4Bits int, v6Bits int) error {
+	if v4Bits < 0 || v4Bits > 32 || v6Bits < 0 || v6Bits > 128 {
+		return fmt.Errorf("invalid prefix lengths: %v, %v", v4Bits, v6Bits)
+	}
+
+	t.v4Bits = v4Bits
+	t.v6Bits = v6Bits
+
+	return nil
+}
+
+// SetMembers replaces every member and weight with a single table rebuild
+func (t *Table) SetMembers(membersMap map[netip.Addr]float64) error {
+	// both forms of an address are one member when canonical, keeping the
+	// largest weight like SetCanonical
+	index := make(map[netip.Addr]int, len(membersMap))
+	members := make([]member, 0, len(membersMap))
+	for addr, weight := range membersMap {
+		if err := checkWeight(weight); err != nil {
+			return err
+		}
+
+		if t.canonical {
+			addr = ipaddr.Canonical(addr)
+		}
+
+		if i, exists := index[addr]; exists {
+			members[i].weight = max(members[i].weight, weight)
+			continue
+		}
+
+		index[addr] = len(members)
+		members = append(members, member{addr: addr, weight: weight, bytes: addr.AsSlice()})
+	}
+
+	return t.update(members)
+}
+
+// Clone returns a copy of the table that can be changed without affecting
+// the original, lookup counters start from the counts of the original but
+// are not shared with it
+func (t *Table) Clone() Table {
+	clone := *t
+	clone.members = slices.Clone(t.members)
+	clone.table = slices.Clone(t.table)
+	clone.metrics = t.metrics.Clone()
+	return clone
+}
+
+// CopyOptions applies the affinity, canonical and metrics options of
+// another table, for instance one with a different key or size that is
+// being replaced. Lookup counts start over
+func (t *Table) CopyOptions(from *Table) {
+	t.v4Bits = from.v4Bits
+	t.v6Bits = from.v6Bits
+	t.SetCanonical(from.canonical)
+	t.SetMetrics(from.metrics.Enabled())
+}
+
+// SetCanonical unmaps IPv4-mapped IPv6 addresses and strips zones from
+// lookups and members so both forms of an address are treated the same,
+// existing members are rewritten and merged if they collide, keeping the
+// largest weight of the merged members
+func (t *Table) SetCanonical(canonical bool) {
+	t.canonical = canonical
+	if !canonical {
+		return
+	}
+
+	changed := false
+	index := make(map[netip.Addr]int, len(t.members))
+	newMembers := make([]member, 0, len(t.members))
+
+	for _, m := range t.members {
+		addr := ipaddr.Canonical(m.addr)
+		if addr != m.addr {
+			changed = true
+		}
+
+		if i, exists := index[addr]; exists {
+			newMembers[i].weight = max(newMembers[i].weight, m.weight)
+			continue
+		}
+
+		index[addr] = len(newMembers)
+		newMembers = append(newMembers, member{addr: addr, weight: m.weight, bytes: addr.AsSlice()})
+	}
+
+	// merging keeps every positive weight positive so this can't leave the
+	// table without an active member
+	if changed {
+		t.members = newMembers
+		t.generateTable()
+	}
+}
+
+func (t *Table) Add(addr netip.Addr, weight float64) error {
+	if err := checkWeight(weight); err != nil {
+		return err
+	}
+
+	if t.canonical {
+		addr = ipaddr.Canonical(addr)
+	}
+
+	newMembers := make([]member, 0, len(t.members)+1)
+	newMembers = append(newMembers, t.members...)
+	newMembers = append(newMembers, member{addr: addr, weight: weight, bytes: addr.AsSlice()})
+
+	return t.update(newMembers)
 }
 
-func (t *Table) Delete(addr netip.Addr) {
+func (t *Table) Delete(addr netip.Addr) error {
+	if t.canonical {
+		addr = ipaddr.Canonical(addr)
+	}
+
 	newMembers := make([]member, 0, len(t.members))
 	for _, member := range t.members {
 		if member.addr != addr {
 			newMembers = append(newMembers, member)
 		}
 	}
-	t.members = newMembers
-	t.generateTable()
+
+	return t.update(newMembers)
 }
 
-func (t *Table) Set(addr netip.Addr, weight float64) {
-	for m, member := range t.members {
+func (t *Table) Set(addr netip.Addr, weight float64) error {
+	if err := checkWeight(weight); err != nil {
+		return err
+	}
+
+	if t.canonical {
+		addr = ipaddr.Canonical(addr)
+	}
+
+	newMembers := make([]member, len(t.members))
+	copy(newMembers, t.members)
+
+	exists := false
+	for m, member := range newMembers {
 		if member.addr == addr {
-			t.members[m].weight = weight
+			newMembers[m].weight = weight
+			exists = true
 			break
 		}
 	}
 
+	if !exists {
+		return fmt.Errorf("member does not exist: %v", addr)
+	}
+
+	return t.update(newMembers)
+}
+
+func (t *Table) AddPrefix(prefix netip.Prefix, weight float64, exclude []netip.Prefix) error {
+	if err := checkWeight(weight); err != nil {
+		return err
+	}
+
+	addrs, err := ipaddr.Expand(prefix, exclude, MaxPrefixMembers)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[netip.Addr]bool, len(t.members))
+	for _, member := range t.members {
+		existing[member.addr] = true
+	}
+
+	newMembers := make([]member, 0, len(t.members)+len(addrs))
+	newMembers = append(newMembers, t.members...)
+	for _, addr := range addrs {
+		if t.canonical {
+			addr = ipaddr.Canonical(addr)
+		}
+
+		if !existing[addr] {
+			existing[addr] = true
+			newMembers = append(newMembers, member{addr: addr, weight: weight, bytes: addr.AsSlice()})
+		}
+	}
+
+	// addresses that are already members don't count twice
+	if len(newMembers) > MaxPrefixMembers {
+		return fmt.Errorf("too many members: %v", len(newMembers))
+	}
+
+	return t.update(newMembers)
+}
+
+// DeletePrefix removes every member inside the prefix
+func (t *Table) DeletePrefix(prefix netip.Prefix) error {
+	if t.canonical {
+		prefix = ipaddr.CanonicalPrefix(prefix)
+	}
+
+	newMembers := make([]member, 0, len(t.members))
+	for _, member := range t.members {
+		if !prefix.Contains(member.addr) {
+			newMembers = append(newMembers, member)
+		}
+	}
+
+	return t.update(newMembers)
+}
+
+// SetPrefix sets the weight of every member inside the prefix
+func (t *Table) SetPrefix(prefix netip.Prefix, weight float64) error {
+	if err := checkWeight(weight); err != nil {
+		return err
+	}
+
+	if t.canonical {
+		prefix = ipaddr.CanonicalPrefix(prefix)
+	}
+
+	newMembers := make([]member, len(t.members))
+	copy(newMembers, t.members)
+
+	for m, member := range newMembers {
+		if prefix.Contains(member.addr) {
+			newMembers[m].weight = weight
+		}
+	}
+
+	return t.update(newMembers)
+}
+
+// Subset returns a stable subset of members for a client, ranked by
+// weighted rendezvous score for the client id. Drained members are never
+// part of a subset
+func (t *Table) Subset(clientID string, size int) []netip.Addr {
+	type scored struct {
+		addr  netip.Addr
+		score float64
+	}
+
+	scores := make([]scored, 0, len(t.members))
+	data := make([]byte, 0, 16+len(clientID))
+
+	for _, member := range t.members {
+		if member.weight <= 0 {
+			continue
+		}
+
+		data = append(data, member.bytes...)
+		data = append(data, clientID...)
+		scores = append(scores, scored{addr: member.addr, score: sumToScore(t.xxhash(data), member.weight)})
+		data = data[:0]
+	}
+
+	slices.SortFunc(scores, func(a scored, b scored) int {
+		return cmp.Compare(b.score, a.score)
+	})
+
+	size = max(0, min(size, len(scores)))
+	subset := make([]netip.Addr, 0, size)
+	for _, s := range scores[:size] {
+		subset = append(subset, s.addr)
+	}
+
+	return subset
+}
+
+// Drain sets the weight of a member to zero, it stays in the table but
+// no longer receives any rows
+func (t *Table) Drain(addr netip.Addr) error {
+	return t.Set(addr, 0)
+}
+
+// Stats returns the number of rows each member owns, drained members are
+// included with zero rows
+func (t *Table) Stats() map[netip.Addr]uint32 {
+	stats := make(map[netip.Addr]uint32, len(t.members))
+	for _, member := range t.members {
+		stats[member.addr] = 0
+	}
+
+	for _, addr := range t.table {
+		stats[addr]++
+	}
+
+	return stats
+}
+
+// SetMetrics turns per member lookup counters on or off, when off Get
+// does no extra work
+func (t *Table) SetMetrics(enabled bool) {
+	t.metrics.SetLookups(enabled, t.addrs(), t.table)
+}
+
+// Metrics returns the lookup counters, row counts and rebuild times, the
+// lookups are nil when metrics are off
+func (t *Table) Metrics() metrics.Snapshot {
+	return t.metrics.Snapshot(t.size, t.Stats())
+}
+
+// WriteMetrics renders Metrics in the prometheus text exposition format
+func (t *Table) WriteMetrics(w io.Writer, namespace string) error {
+	return metrics.WritePrometheus(w, namespace, t.Metrics())
+}
+
+// update swaps in a new member list and regenerates the table, if no
+// member would be left with a positive weight the table is left untouched
+func (t *Table) update(members []member) error {
+	active := 0
+	for _, member := range members {
+		if member.weight > 0 {
+			active++
+		}
+	}
+
+	if active < 1 {
+		return fmt.Errorf("too few members with positive weight: %v", active)
+	}
+
+	t.members = members
 	t.generateTable()
+
+	return nil
+}
+
+// Rows returns the primary and secondary (runner up) member for every row
+// in the table, the secondary is the same as the primary with one member
+func (t *Table) Rows() ([]netip.Addr, []netip.Addr) {
+	primary := make([]netip.Addr, t.size)
+	secondary := make([]netip.Addr, t.size)
+	bI := make([]byte, 4)
+	data := make([]byte, 0, 20)
+
+	for i := uint32(0); i < t.size; i++ {
+		primary[i], secondary[i] = t.rankRow(i, bI, data)
+	}
+
+	return primary, secondary
 }
 
 func (t *Table) generateTable() {
+	start := time.Now()
 	bI := make([]byte, 4)
 	table := make([]netip.Addr, t.size)
 	data := make([]byte, 0, 20) // 16+4 enough for v6 addr + bI
 
 	for i := uint32(0); i < t.size; i++ {
-		var highScore float64
-		var highMember netip.Addr
+		table[i], _ = t.rankRow(i, bI, data)
+	}
 
-		binary.LittleEndian.PutUint32(bI, i)
+	t.table = table
+	t.metrics.Rebuilt(start, t.addrs(), table)
+}
 
-		for _, member := range t.members {
-			// hash the entry plus the table row index
-			data = append(data, member.bytes...)
-			data = append(data, bI...)
-			sum := t.xxhash(data)
-			data = data[:0] // clear it out before we use it again
+// rankRow returns the highest and second highest scoring members for a row
+func (t *Table) rankRow(i uint32, bI []byte, data []byte) (netip.Addr, netip.Addr) {
+	var highScore, secondScore float64
+	var highMember, secondMember netip.Addr
 
-			score := sumToScore(sum, member.weight)
+	binary.LittleEndian.PutUint32(bI, i)
 
-			if score > highScore {
-				highScore = score
-				highMember = member.addr
-			}
+	for _, member := range t.members {
+		// drained members never win a row
+		if member.weight <= 0 {
+			continue
 		}
 
-		table[i] = highMember
+		// hash the entry plus the table row index
+		data = append(data, member.bytes...)
+		data = append(data, bI...)
+		sum := t.xxhash(data)
+		data = data[:0] // clear it out before we use it again
+
+		score := sumToScore(sum, member.weight)
+
+		if score > highScore {
+			secondScore, secondMember = highScore, highMember
+			highScore = score
+			highMember = member.addr
+		} else if score > secondScore {
+			secondScore = score
+			secondMember = member.addr
+		}
 	}
 
-	t.table = table
+	if !secondMember.IsValid() {
+		secondMember = highMember
+	}
+
+	return highMember, secondMember
+}
+
+func (t *Table) row(addr netip.Addr) uint64 {
+	if t.canonical {
+		addr = ipaddr.Canonical(addr)
+	}
+
+	if t.v4Bits < 32 || t.v6Bits < 128 {
+		addr = ipaddr.Mask(addr, t.v4Bits, t.v6Bits)
+	}
+
+	return t.xxhash(addr.AsSlice()) & uint64(t.size-1)
+}
+
+// addrs returns the address of every member, drained or not
+func (t *Table) addrs() []netip.Addr {
+	addrs := make([]netip.Addr, 0, len(t.members))
+	for _, member := range t.members {
+		addrs = append(addrs, member.addr)
+	}
+	return addrs
 }
 
 func (t *Table) xxhash(data []byte) uint64 {
 	return xxhash.Checksum64S(data, t.key)
 }
 
+func checkWeight(weight float64) error {
+	if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+		return fmt.Errorf("invalid weight: %v", weight)
+	}
+	return nil
+}
+
 func sumToScore(sum uint64, weight float64) float64 {
 	// this seems to work but what do i know i am just a dog at at computer
 	// https://github.com/golang/go/issues/12290
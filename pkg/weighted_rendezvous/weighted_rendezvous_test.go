@@ -1,13 +1,92 @@
 package weighted_rendezvous
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
 	"net/netip"
 	"testing"
 
+	"github.com/joewilliams/rama/internal/golden"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slices"
 )
 
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// the golden files hashed for each TableFormatVersion, pin a new sum when
+// bumping the version rather than changing an old one
+var goldenSums = map[int]string{
+	1: "3e905a092d35a2f8846afe7759f8eae5cb684fbd17448b044fc64eed247f8ee6",
+}
+
+type goldenTable struct {
+	Version int                    `json:"version"`
+	Key     uint64                 `json:"key"`
+	Size    uint32                 `json:"size"`
+	Members map[netip.Addr]float64 `json:"members"`
+	Lookups map[string]string      `json:"lookups"`
+	Table   []netip.Addr           `json:"table"`
+}
+
+func TestGolden(t *testing.T) {
+	mixed := map[netip.Addr]float64{}
+	for i := 1; i <= 3; i++ {
+		mixed[netip.MustParseAddr(fmt.Sprintf("192.0.2.%v", i))] = float64(i * 10)
+		mixed[netip.MustParseAddr(fmt.Sprintf("2001:db8::%v", i))] = float64(i) / 10
+	}
+
+	many := map[netip.Addr]float64{}
+	for i := 1; i <= 20; i++ {
+		many[netip.MustParseAddr(fmt.Sprintf("10.0.%v.1", i))] = float64(i)
+	}
+
+	cases := map[string]goldenTable{
+		"golden_default.json": {Key: 1234567812345678, Members: map[netip.Addr]float64{
+			netip.MustParseAddr("192.0.2.111"): 10,
+			netip.MustParseAddr("192.0.2.112"): 20,
+			netip.MustParseAddr("192.0.2.113"): 70,
+		}},
+		"golden_mixed.json": {Key: 42, Size: 1024, Members: mixed},
+		"golden_drained.json": {Key: 9999, Size: 64, Members: map[netip.Addr]float64{
+			netip.MustParseAddr("192.0.2.1"): 1,
+			netip.MustParseAddr("192.0.2.2"): 0,
+		}},
+		"golden_many.json": {Key: 1, Size: 2048, Members: many},
+	}
+
+	files := map[string]any{}
+	for name, c := range cases {
+		var table Table
+		var err error
+
+		if c.Size == 0 {
+			table, err = New(c.Key, c.Members)
+		} else {
+			table, err = NewWithTableSize(c.Key, c.Size, c.Members)
+		}
+		assert.Nil(t, err)
+
+		got := goldenTable{
+			Version: TableFormatVersion,
+			Key:     c.Key,
+			Size:    table.size,
+			Members: c.Members,
+			Lookups: map[string]string{},
+			Table:   table.table,
+		}
+
+		for i := 0; i < 16; i++ {
+			lookup := fmt.Sprintf("198.51.100.%v", i)
+			got.Lookups[lookup] = table.Get(netip.MustParseAddr(lookup)).String()
+		}
+
+		files[name] = got
+	}
+
+	golden.Check(t, TableFormatVersion, goldenSums, *update, files)
+}
+
 func TestNew(t *testing.T) {
 	ips := map[netip.Addr]float64{
 		netip.MustParseAddr("192.0.2.111"): 10,
@@ -195,6 +274,415 @@ func TestNew(t *testing.T) {
 	assert.Equal(t, totalAdd, float64(1))
 }
 
+func TestDrain(t *testing.T) {
+	ips := map[netip.Addr]float64{
+		netip.MustParseAddr("192.0.2.111"): 10,
+		netip.MustParseAddr("192.0.2.112"): 20,
+		netip.MustParseAddr("192.0.2.113"): 70,
+	}
+
+	table, err := New(1234567812345678, ips)
+	assert.Nil(t, err)
+
+	toDrain := netip.MustParseAddr("192.0.2.112")
+	want := map[string]netip.Addr{}
+
+	for i := 0; i < 22; i++ {
+		stringIP := fmt.Sprintf("192.0.2.%v", i)
+		want[stringIP] = table.Get(netip.MustParseAddr(stringIP))
+	}
+
+	err = table.Drain(toDrain)
+	assert.Nil(t, err)
+
+	stats := table.Stats()
+	assert.Equal(t, 3, len(stats))
+	assert.Equal(t, uint32(0), stats[toDrain])
+	assert.Equal(t, uint32(len(table.table)), stats[netip.MustParseAddr("192.0.2.111")]+stats[netip.MustParseAddr("192.0.2.113")])
+
+	for k, v := range want {
+		ip := table.Get(netip.MustParseAddr(k))
+		assert.True(t, ip.IsValid())
+
+		// only the drained members rows should move
+		if v == toDrain {
+			assert.NotEqual(t, toDrain, ip)
+		} else {
+			assert.Equal(t, v, ip)
+		}
+	}
+
+	// draining everything is refused and the last good table is kept
+	err = table.Drain(netip.MustParseAddr("192.0.2.111"))
+	assert.Nil(t, err)
+
+	err = table.Drain(netip.MustParseAddr("192.0.2.113"))
+	assert.NotNil(t, err)
+
+	err = table.Delete(netip.MustParseAddr("192.0.2.113"))
+	assert.NotNil(t, err)
+
+	for _, ip := range table.table {
+		assert.Equal(t, netip.MustParseAddr("192.0.2.113"), ip)
+	}
+
+	// undrain
+	err = table.Set(toDrain, 20)
+	assert.Nil(t, err)
+	assert.Greater(t, table.Stats()[toDrain], uint32(0))
+
+	err = table.Set(toDrain, -1)
+	assert.NotNil(t, err)
+
+	// setting a non-member is refused rather than rebuilding for nothing
+	rebuilds := table.Metrics().Rebuilds
+	err = table.Set(netip.MustParseAddr("192.0.2.114"), 20)
+	assert.NotNil(t, err)
+	assert.Equal(t, rebuilds, table.Metrics().Rebuilds)
+	assert.Equal(t, 3, len(table.Stats()))
+}
+
+func TestPrefixes(t *testing.T) {
+	prefixes := map[netip.Prefix]float64{
+		netip.MustParsePrefix("192.0.2.0/28"):   10,
+		netip.MustParsePrefix("2001:db8::/126"): 30,
+	}
+
+	exclude := []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.0/32"),
+		netip.MustParsePrefix("192.0.2.15/32"),
+	}
+
+	table, err := NewFromPrefixes(1234567812345678, prefixes, exclude)
+	assert.Nil(t, err)
+
+	stats := table.Stats()
+	assert.Equal(t, 18, len(stats))
+	assert.NotContains(t, stats, netip.MustParseAddr("192.0.2.0"))
+	assert.NotContains(t, stats, netip.MustParseAddr("192.0.2.15"))
+
+	for _, member := range table.members {
+		if member.addr.Is6() {
+			assert.Equal(t, float64(30), member.weight)
+		} else {
+			assert.Equal(t, float64(10), member.weight)
+		}
+	}
+
+	err = table.SetPrefix(netip.MustParsePrefix("2001:db8::/64"), 0)
+	assert.Nil(t, err)
+
+	for addr, rows := range table.Stats() {
+		if addr.Is6() {
+			assert.Equal(t, uint32(0), rows)
+		}
+	}
+
+	err = table.DeletePrefix(netip.MustParsePrefix("192.0.2.0/24"))
+	assert.NotNil(t, err)
+
+	err = table.AddPrefix(netip.MustParsePrefix("198.51.100.0/30"), 5, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 22, len(table.Stats()))
+
+	err = table.DeletePrefix(netip.MustParsePrefix("192.0.2.0/24"))
+	assert.Nil(t, err)
+	assert.Equal(t, 8, len(table.Stats()))
+
+	err = table.AddPrefix(netip.MustParsePrefix("10.0.0.0/8"), 5, nil)
+	assert.NotNil(t, err)
+
+	// the limit counts members after overlaps with existing ones are removed
+	half := map[netip.Addr]float64{}
+	for addr := netip.MustParseAddr("10.0.0.0"); len(half) < MaxPrefixMembers/2; addr = addr.Next() {
+		half[addr] = 1
+	}
+	full, err := NewWithTableSize(1234, 16, half)
+	assert.Nil(t, err)
+	err = full.AddPrefix(netip.MustParsePrefix("10.0.0.0/20"), 1, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, MaxPrefixMembers, len(full.Stats()))
+	err = full.AddPrefix(netip.MustParsePrefix("10.0.0.0/20"), 1, nil)
+	assert.Nil(t, err)
+	err = full.AddPrefix(netip.MustParsePrefix("10.1.0.0/32"), 1, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, MaxPrefixMembers, len(full.Stats()))
+
+	_, err = NewFromPrefixes(1234, map[netip.Prefix]float64{
+		netip.MustParsePrefix("192.0.2.0/28"): 10,
+		netip.MustParsePrefix("192.0.2.0/30"): 20,
+	}, nil)
+	assert.NotNil(t, err)
+
+	// overlapping prefixes with the same weight are only expanded once
+	overlap, err := NewFromPrefixes(1234, map[netip.Prefix]float64{
+		netip.MustParsePrefix("192.0.2.0/28"): 10,
+		netip.MustParsePrefix("192.0.2.0/30"): 10,
+	}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 16, len(overlap.Stats()))
+}
+
+func TestAffinity(t *testing.T) {
+	table, err := New(1234567812345678, map[netip.Addr]float64{
+		netip.MustParseAddr("192.0.2.1"): 10,
+		netip.MustParseAddr("192.0.2.2"): 20,
+		netip.MustParseAddr("192.0.2.3"): 30,
+		netip.MustParseAddr("192.0.2.4"): 40,
+	})
+	assert.Nil(t, err)
+
+	err = table.SetAffinity(24, 56)
+	assert.Nil(t, err)
+
+	// every client in the /24 or /56 maps to the same member
+	v4 := table.Get(netip.MustParseAddr("198.51.100.0"))
+	v6 := table.Get(netip.MustParseAddr("2001:db8:0:100::"))
+	for i := 0; i <= 255; i++ {
+		assert.Equal(t, v4, table.Get(netip.MustParseAddr(fmt.Sprintf("198.51.100.%v", i))))
+		assert.Equal(t, v6, table.Get(netip.MustParseAddr(fmt.Sprintf("2001:db8:0:1%02x:%x::1", i, i))))
+	}
+
+	// mapped clients without canonicalization use the v4 prefix length on
+	// their low 32 bits rather than the v6 one
+	mapped := table.Get(netip.MustParseAddr("::ffff:198.51.100.0"))
+	seen := map[netip.Addr]bool{}
+	for i := 0; i <= 255; i++ {
+		assert.Equal(t, mapped, table.Get(netip.MustParseAddr(fmt.Sprintf("::ffff:198.51.100.%v", i))))
+		seen[table.Get(netip.MustParseAddr(fmt.Sprintf("::ffff:198.51.%v.1", i)))] = true
+	}
+	assert.Greater(t, len(seen), 1)
+
+	// and the lookup still doesn't allocate
+	lookup := netip.MustParseAddr("2001:db8::1")
+	assert.Equal(t, float64(0), testing.AllocsPerRun(100, func() { table.Get(lookup) }))
+
+	// turning it off goes back to hashing the whole address
+	err = table.SetAffinity(32, 128)
+	assert.Nil(t, err)
+
+	seen = map[netip.Addr]bool{}
+	for i := 0; i <= 255; i++ {
+		seen[table.Get(netip.MustParseAddr(fmt.Sprintf("198.51.100.%v", i)))] = true
+	}
+	assert.Greater(t, len(seen), 1)
+
+	err = table.SetAffinity(33, 56)
+	assert.NotNil(t, err)
+
+	err = table.SetAffinity(24, -1)
+	assert.NotNil(t, err)
+}
+
+func TestCanonical(t *testing.T) {
+	table, err := New(1234567812345678, map[netip.Addr]float64{
+		netip.MustParseAddr("::ffff:192.0.2.1"): 10,
+		netip.MustParseAddr("::ffff:192.0.2.2"): 20,
+		netip.MustParseAddr("fe80::1%eth0"):     30,
+	})
+	assert.Nil(t, err)
+
+	table.SetCanonical(true)
+
+	stats := table.Stats()
+	assert.Equal(t, 3, len(stats))
+	assert.Contains(t, stats, netip.MustParseAddr("192.0.2.1"))
+	assert.Contains(t, stats, netip.MustParseAddr("192.0.2.2"))
+	assert.Contains(t, stats, netip.MustParseAddr("fe80::1"))
+
+	for i := 0; i <= 255; i++ {
+		v4 := netip.MustParseAddr(fmt.Sprintf("198.51.100.%v", i))
+		mapped := netip.MustParseAddr(fmt.Sprintf("::ffff:198.51.100.%v", i))
+		assert.Equal(t, table.Get(v4), table.Get(mapped))
+	}
+
+	err = table.Set(netip.MustParseAddr("::ffff:192.0.2.1"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), table.Stats()[netip.MustParseAddr("192.0.2.1")])
+
+	err = table.Delete(netip.MustParseAddr("fe80::1%eth1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(table.Stats()))
+
+	// mapped prefixes match the canonical members they cover
+	err = table.SetPrefix(netip.MustParsePrefix("::ffff:192.0.2.0/126"), 5)
+	assert.Nil(t, err)
+	for _, member := range table.members {
+		assert.Equal(t, float64(5), member.weight)
+	}
+
+	err = table.Add(netip.MustParseAddr("192.0.2.9"), 10)
+	assert.Nil(t, err)
+	err = table.DeletePrefix(netip.MustParsePrefix("::ffff:192.0.2.0/126"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[netip.Addr]uint32{netip.MustParseAddr("192.0.2.9"): table.Size()}, table.Stats())
+
+	err = table.Delete(netip.MustParseAddr("::ffff:192.0.2.9"))
+	assert.NotNil(t, err)
+
+	// so does replacing every member
+	err = table.SetMembers(map[netip.Addr]float64{
+		netip.MustParseAddr("192.0.2.1"):        10,
+		netip.MustParseAddr("::ffff:192.0.2.1"): 30,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(table.members))
+	assert.Equal(t, float64(30), table.members[0].weight)
+
+	// colliding members keep the largest weight whatever order the map
+	// handed them over in
+	for i := 0; i < 20; i++ {
+		collide, err := New(1234567812345678, map[netip.Addr]float64{
+			netip.MustParseAddr("192.0.2.1"):        10,
+			netip.MustParseAddr("::ffff:192.0.2.1"): 40,
+			netip.MustParseAddr("192.0.2.2"):        0,
+			netip.MustParseAddr("::ffff:192.0.2.2"): 20,
+			netip.MustParseAddr("192.0.2.3"):        30,
+		})
+		assert.Nil(t, err)
+
+		collide.SetCanonical(true)
+
+		weights := map[netip.Addr]float64{}
+		for _, member := range collide.members {
+			weights[member.addr] = member.weight
+		}
+
+		assert.Equal(t, map[netip.Addr]float64{
+			netip.MustParseAddr("192.0.2.1"): 40,
+			netip.MustParseAddr("192.0.2.2"): 20,
+			netip.MustParseAddr("192.0.2.3"): 30,
+		}, weights)
+	}
+}
+
+func TestSubset(t *testing.T) {
+	ips := map[netip.Addr]float64{}
+	for i := 1; i <= 10; i++ {
+		ips[netip.MustParseAddr(fmt.Sprintf("192.0.2.%v", i))] = 10
+	}
+	heavy := netip.MustParseAddr("192.0.2.100")
+	ips[heavy] = 100
+
+	table, err := New(1234567812345678, ips)
+	assert.Nil(t, err)
+
+	counts := map[netip.Addr]int{}
+	subsets := map[string][]netip.Addr{}
+
+	for i := 0; i < 1000; i++ {
+		client := fmt.Sprintf("proxy-%v", i)
+		subset := table.Subset(client, 3)
+		assert.Equal(t, 3, len(subset))
+		assert.Equal(t, subset, table.Subset(client, 3))
+
+		subsets[client] = subset
+		for _, ip := range subset {
+			counts[ip]++
+		}
+	}
+
+	// the heavy member is in more subsets than any other
+	for ip, count := range counts {
+		if ip != heavy {
+			assert.Greater(t, counts[heavy], count)
+		}
+	}
+
+	// drained members are dropped and only their subsets change
+	toDrain := netip.MustParseAddr("192.0.2.1")
+	err = table.Drain(toDrain)
+	assert.Nil(t, err)
+
+	for client, before := range subsets {
+		after := table.Subset(client, 3)
+		assert.NotContains(t, after, toDrain)
+
+		if !slices.Contains(before, toDrain) {
+			assert.Equal(t, before, after)
+		}
+	}
+
+	assert.Equal(t, 10, len(table.Subset("proxy-0", 100)))
+}
+
+func TestMetrics(t *testing.T) {
+	ips := []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("192.0.2.3"),
+	}
+
+	table, err := NewWithTableSize(1234567812345678, 256, map[netip.Addr]float64{
+		ips[0]: 10,
+		ips[1]: 20,
+		ips[2]: 30,
+	})
+	assert.Nil(t, err)
+
+	// off by default
+	table.Get(netip.MustParseAddr("198.51.100.1"))
+	assert.Nil(t, table.Metrics().Lookups)
+
+	table.SetMetrics(true)
+
+	want := map[netip.Addr]uint64{}
+	for i := 0; i <= 255; i++ {
+		want[table.Get(netip.MustParseAddr(fmt.Sprintf("198.51.100.%v", i)))]++
+	}
+
+	snapshot := table.Metrics()
+	assert.Equal(t, want, snapshot.Lookups)
+	assert.Equal(t, uint32(256), snapshot.Size)
+	assert.Equal(t, uint64(1), snapshot.Rebuilds)
+
+	// counts of members that stay are carried across rebuilds
+	err = table.Delete(ips[2])
+	assert.Nil(t, err)
+
+	snapshot = table.Metrics()
+	assert.Equal(t, uint64(2), snapshot.Rebuilds)
+	assert.Equal(t, want[ips[0]], snapshot.Lookups[ips[0]])
+	assert.Equal(t, want[ips[1]], snapshot.Lookups[ips[1]])
+	assert.NotContains(t, snapshot.Lookups, ips[2])
+
+	var buf bytes.Buffer
+	err = table.WriteMetrics(&buf, "rama")
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), fmt.Sprintf("rama_lookups_total{member=\"192.0.2.1\"} %v\n", want[ips[0]]))
+	assert.Contains(t, buf.String(), "rama_rebuilds_total 2\n")
+
+	// clones start from the same counts but count on their own
+	clone := table.Clone()
+	clone.Get(netip.MustParseAddr("198.51.100.1"))
+	assert.Equal(t, snapshot.Lookups, table.Metrics().Lookups)
+	assert.NotEqual(t, snapshot.Lookups, clone.Metrics().Lookups)
+
+	table.SetMetrics(false)
+	assert.Nil(t, table.Metrics().Lookups)
+}
+
+func TestRows(t *testing.T) {
+	ips := map[netip.Addr]float64{
+		netip.MustParseAddr("192.0.2.1"): 10,
+		netip.MustParseAddr("192.0.2.2"): 20,
+		netip.MustParseAddr("192.0.2.3"): 0,
+	}
+
+	table, err := New(1234567812345678, ips)
+	assert.Nil(t, err)
+
+	primary, secondary := table.Rows()
+	assert.Equal(t, table.table, primary)
+	assert.Equal(t, table.Size(), uint32(len(primary)))
+
+	for i := range primary {
+		// drained members are never a secondary either
+		assert.NotEqual(t, primary[i], secondary[i])
+		assert.NotEqual(t, netip.MustParseAddr("192.0.2.3"), secondary[i])
+	}
+}
+
 func TestGetKeys(t *testing.T) {
 	ips := map[netip.Addr]float64{
 		netip.MustParseAddr("192.0.2.1"): 0.1,
@@ -212,6 +700,73 @@ func TestGetKeys(t *testing.T) {
 func TestBadNew(t *testing.T) {
 	_, err := New(0, map[netip.Addr]float64{})
 	assert.NotNil(t, err)
+
+	_, err = New(0, map[netip.Addr]float64{netip.MustParseAddr("192.0.2.1"): 0})
+	assert.NotNil(t, err)
+}
+
+func FuzzSet(f *testing.F) {
+	f.Add(uint64(1234), []byte{0, 0, 1, 0, 2, 0, 0, 10})
+	f.Add(uint64(0), []byte{1, 255, 2, 128, 0, 1, 1, 0, 2, 0})
+
+	// ops are a member index followed by a weight byte, weights of 255 are
+	// treated as invalid negative weights
+	f.Fuzz(func(t *testing.T, key uint64, ops []byte) {
+		members := []netip.Addr{
+			netip.MustParseAddr("192.0.2.1"),
+			netip.MustParseAddr("192.0.2.2"),
+			netip.MustParseAddr("2001:db8::1"),
+		}
+
+		table, err := NewWithTableSize(key, 64, map[netip.Addr]float64{
+			members[0]: 1,
+			members[1]: 1,
+			members[2]: 1,
+		})
+		assert.Nil(t, err)
+
+		weights := map[netip.Addr]float64{members[0]: 1, members[1]: 1, members[2]: 1}
+		lookup := netip.AddrFrom4([4]byte{198, 51, 100, byte(key)})
+
+		for i := 0; i+1 < len(ops); i = i + 2 {
+			addr := members[int(ops[i])%len(members)]
+			weight := float64(ops[i+1])
+			if ops[i+1] == 255 {
+				weight = -1
+			}
+
+			before := make([]netip.Addr, len(table.table))
+			copy(before, table.table)
+
+			err := table.Set(addr, weight)
+
+			active := 0
+			for m, w := range weights {
+				if m == addr {
+					w = weight
+				}
+				if w > 0 {
+					active++
+				}
+			}
+
+			if weight < 0 || active == 0 {
+				// failed updates leave the table untouched
+				assert.NotNil(t, err)
+				assert.Equal(t, before, table.table)
+			} else {
+				assert.Nil(t, err)
+				weights[addr] = weight
+			}
+
+			for _, ip := range table.table {
+				assert.True(t, ip.IsValid())
+				assert.Greater(t, weights[ip], float64(0))
+			}
+
+			assert.True(t, table.Get(lookup).IsValid())
+		}
+	})
 }
 
 func BenchmarkGenerateOneEntry(b *testing.B) {
@@ -264,3 +819,37 @@ func BenchmarkGenerateLookup(b *testing.B) {
 		table.Get(lookupIP)
 	}
 }
+
+func BenchmarkGenerateLookupAffinity(b *testing.B) {
+	table, _ := New(1234, map[netip.Addr]float64{
+		netip.MustParseAddr("192.0.2.1"): 10,
+		netip.MustParseAddr("192.0.2.2"): 20,
+		netip.MustParseAddr("192.0.2.3"): 30,
+	})
+
+	table.SetAffinity(24, 56)
+
+	lookupIP := netip.MustParseAddr("2001:db8::1")
+
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		table.Get(lookupIP)
+	}
+}
+
+func BenchmarkGenerateLookupMetrics(b *testing.B) {
+	table, _ := New(1234, map[netip.Addr]float64{
+		netip.MustParseAddr("192.0.2.1"): 10,
+		netip.MustParseAddr("192.0.2.2"): 20,
+		netip.MustParseAddr("192.0.2.3"): 30,
+	})
+
+	table.SetMetrics(true)
+
+	lookupIP := netip.MustParseAddr("192.0.2.4")
+
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		table.Get(lookupIP)
+	}
+}